@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type snapshot struct {
+	Users      map[string]User `json:"users"`
+	NextUserID int             `json:"next_user_id"`
+}
+
+// checkAdmin reports whether r carries the admin bearer token, writing the
+// rejection itself when it does not.
+func checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if config.AdminToken == "" {
+		httpError(w, r, http.StatusForbidden, "admin_disabled")
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		httpError(w, r, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	return true
+}
+
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkAdmin(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func validateSnapshot(s snapshot) error {
+	if s.Users == nil {
+		return errors.New("users is missing")
+	}
+
+	externalIDs := make(map[string]string)
+	for id, user := range s.Users {
+		if id == "" {
+			return errors.New("empty user ID")
+		}
+		if user.ExternalID != "" {
+			if other, taken := externalIDs[user.ExternalID]; taken {
+				return fmt.Errorf("users %s and %s share external ID %s", other, id, user.ExternalID)
+			}
+			externalIDs[user.ExternalID] = id
+		}
+		if n, err := strconv.Atoi(id); err == nil && n >= s.NextUserID {
+			return fmt.Errorf("next_user_id %d must be greater than user ID %s", s.NextUserID, id)
+		}
+		for _, friendID := range user.friendIDs() {
+			if _, ok := s.Users[friendID]; !ok {
+				return fmt.Errorf("user %s references unknown friend %s", id, friendID)
+			}
+		}
+	}
+
+	if s.NextUserID < 1 {
+		return errors.New("next_user_id must be positive")
+	}
+	return nil
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	w.Header().Set("Content-Disposition", `attachment; filename="snapshot.json"`)
+	writeJSON(w, r, http.StatusOK, snapshot{Users: users, NextUserID: nextUserID})
+}
+
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	var s snapshot
+	if err := decodeJSON(r, &s); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+
+	anomalies := normalizeUsers(s.Users)
+	if err := validateSnapshot(s); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_snapshot", err)
+		return
+	}
+	if anomalies > 0 {
+		log.Printf("restore: fixed %d friend list anomalies", anomalies)
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	replaceUsers(s.Users)
+	nextUserID = s.NextUserID
+	undoLog = nil
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, msg(r, "state_restored", len(users)))
+}
+
+func inactive(user User, cutoff time.Time) bool {
+	return len(user.Friends) == 0 && user.CreatedAt.Before(cutoff)
+}
+
+// purgeInactiveHandler deletes friendless users created before older_than.
+// Candidates are collected under the read lock and re-checked under the write
+// lock, so a user who made a friend in between is kept.
+func purgeInactiveHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("older_than") == "" {
+		writeQueryError(w, r, invalidParam("older_than"))
+		return
+	}
+	cutoff, qerr := parseTimeParam(q, "older_than")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	dryRun, qerr := parseBoolParam(q, "dry_run", false)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	candidates := []string{}
+	for id, user := range users {
+		if inactive(user, cutoff) {
+			candidates = append(candidates, id)
+		}
+	}
+	usersMutex.RUnlock()
+
+	purged := candidates
+	if !dryRun {
+		purged = []string{}
+		usersMutex.Lock()
+		for _, id := range candidates {
+			if user, ok := users[id]; ok && inactive(user, cutoff) {
+				removeUser(id)
+				purged = append(purged, id)
+			}
+		}
+		usersMutex.Unlock()
+	}
+	sortIDs(purged)
+
+	writeJSON(w, r, http.StatusOK, struct {
+		DryRun bool     `json:"dry_run"`
+		Count  int      `json:"count"`
+		IDs    []string `json:"ids"`
+	}{dryRun, len(purged), purged})
+}
+
+type integrityViolation struct {
+	Kind     string `json:"kind"`
+	UserID   string `json:"user_id"`
+	FriendID string `json:"friend_id"`
+}
+
+type integrityReport struct {
+	Valid      bool                 `json:"valid"`
+	Counts     map[string]int       `json:"counts"`
+	Violations []integrityViolation `json:"violations"`
+}
+
+// checkIntegrity lists every broken friend list invariant in all. It only
+// reports; normalizeUsers is what repairs self-loops and duplicates.
+func checkIntegrity(all map[string]User) integrityReport {
+	report := integrityReport{
+		Counts: map[string]int{
+			"self_loop":          0,
+			"duplicate_friend":   0,
+			"dangling_reference": 0,
+			"asymmetric_edge":    0,
+		},
+		Violations: []integrityViolation{},
+	}
+	add := func(kind, userID, friendID string) {
+		report.Counts[kind]++
+		report.Violations = append(report.Violations, integrityViolation{kind, userID, friendID})
+	}
+
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	for _, id := range ids {
+		seen := make(map[string]bool, len(all[id].Friends))
+		for _, friendID := range all[id].friendIDs() {
+			switch friend, exists := all[friendID]; {
+			case friendID == id:
+				add("self_loop", id, friendID)
+			case seen[friendID]:
+				add("duplicate_friend", id, friendID)
+			case !exists:
+				add("dangling_reference", id, friendID)
+			case !friend.hasFriend(id):
+				add("asymmetric_edge", id, friendID)
+			}
+			seen[friendID] = true
+		}
+	}
+
+	report.Valid = len(report.Violations) == 0
+	return report
+}
+
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	report := checkIntegrity(users)
+	usersMutex.RUnlock()
+
+	writeJSON(w, r, http.StatusOK, report)
+}
+
+// maintenanceHandler turns maintenance mode on or off with ?enabled, and
+// reports the resulting mode.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("enabled") == "" {
+		writeQueryError(w, r, invalidParam("enabled"))
+		return
+	}
+	enabled, qerr := parseBoolParam(q, "enabled", false)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	if maintenance.Swap(enabled) != enabled {
+		log.Printf("maintenance mode enabled=%t", enabled)
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Maintenance bool `json:"maintenance"`
+	}{enabled})
+}
+
+// orphanEdges maps each user with dangling friend references to the missing
+// friend IDs, in list order. The caller must hold usersMutex.
+func orphanEdges() map[string][]string {
+	orphans := make(map[string][]string)
+	for id, user := range users {
+		for _, friendID := range user.friendIDs() {
+			if _, ok := users[friendID]; !ok {
+				orphans[id] = append(orphans[id], friendID)
+			}
+		}
+	}
+	return orphans
+}
+
+func writeOrphanEdges(w http.ResponseWriter, r *http.Request, orphans map[string][]string) {
+	count := 0
+	for _, missing := range orphans {
+		count += len(missing)
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Count   int                 `json:"count"`
+		Orphans map[string][]string `json:"orphans"`
+	}{count, orphans})
+}
+
+// getOrphanEdgesHandler reports friend references to users that do not
+// exist, which restores and hand-edited state files can leave behind.
+func getOrphanEdgesHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	orphans := orphanEdges()
+	usersMutex.RUnlock()
+
+	writeOrphanEdges(w, r, orphans)
+}
+
+// deleteOrphanEdgesHandler removes the references getOrphanEdgesHandler
+// reports and returns what it removed.
+func deleteOrphanEdgesHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.Lock()
+	orphans := orphanEdges()
+	for id, missing := range orphans {
+		user := users[id]
+		for _, friendID := range missing {
+			user.Friends = removeFriendID(user.Friends, friendID)
+		}
+		putUser(id, user)
+	}
+	usersMutex.Unlock()
+
+	if len(orphans) > 0 {
+		log.Printf("removed dangling friend references from %d users", len(orphans))
+	}
+	writeOrphanEdges(w, r, orphans)
+}
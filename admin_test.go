@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "s3cret"
+
+// withAdmin turns on the admin routes and returns the header pair that
+// authorizes a request to them.
+func withAdmin(t *testing.T) []string {
+	t.Helper()
+	config.AdminToken = testAdminToken
+	return []string{"Authorization", "Bearer " + testAdminToken}
+}
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+
+	a, b, c := createUser(t, h, "a", 20), createUser(t, h, "b", 30), createUser(t, h, "c", 40)
+	makeFriends(t, h, a, b, b, c)
+
+	rec := do(t, h, http.MethodGet, "/admin/snapshot", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	saved := rec.Body.String()
+
+	resetState(t)
+	admin = withAdmin(t)
+	h = newRouter()
+	createUser(t, h, "other", 50)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/restore", saved, admin...), http.StatusOK)
+
+	rec = do(t, h, http.MethodGet, "/admin/snapshot", "", admin...)
+	if got := rec.Body.String(); got != saved {
+		t.Errorf("snapshot after restore differs:\n got %s\nwant %s", got, saved)
+	}
+	if id := createUser(t, h, "d", 20); id != "4" {
+		t.Errorf("next user ID = %s, want 4", id)
+	}
+}
+
+func TestRestoreRejectsInvalidSnapshot(t *testing.T) {
+	tests := map[string]string{
+		"missing users":    `{"next_user_id":1}`,
+		"unknown friend":   `{"users":{"1":{"name":"a","friends":["2"]}},"next_user_id":2}`,
+		"stale next ID":    `{"users":{"1":{"name":"a"}},"next_user_id":1}`,
+		"not a snapshot":   `[]`,
+		"shared external":  `{"users":{"1":{"name":"a","external_id":"x"},"2":{"name":"b","external_id":"x"}},"next_user_id":3}`,
+		"bad next user ID": `{"users":{},"next_user_id":0}`,
+	}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			resetState(t)
+			admin := withAdmin(t)
+			h := newRouter()
+			id := createUser(t, h, "kept", 20)
+
+			expectStatus(t, do(t, h, http.MethodPost, "/admin/restore", body, admin...), http.StatusBadRequest)
+			expectStatus(t, do(t, h, http.MethodGet, "/user/"+id, ""), http.StatusOK)
+		})
+	}
+}
+
+func TestAdminRoutesRequireToken(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	expectStatus(t, do(t, h, http.MethodGet, "/admin/snapshot", ""), http.StatusForbidden)
+
+	withAdmin(t)
+	h = newRouter()
+	expectStatus(t, do(t, h, http.MethodGet, "/admin/snapshot", ""), http.StatusUnauthorized)
+	expectStatus(t, do(t, h, http.MethodGet, "/admin/snapshot", "", "Authorization", "Bearer wrong"), http.StatusUnauthorized)
+}
+
+type purgeResult struct {
+	DryRun bool     `json:"dry_run"`
+	Count  int      `json:"count"`
+	IDs    []string `json:"ids"`
+}
+
+func TestPurgeInactive(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	fake := useFakeClock(start)
+	h := newRouter()
+
+	oldLonely, oldFriend, oldFriend2 := createUser(t, h, "old lonely", 20), createUser(t, h, "old friend", 20), createUser(t, h, "old friend 2", 20)
+	makeFriends(t, h, oldFriend, oldFriend2)
+	fake.Advance(48 * time.Hour)
+	newLonely := createUser(t, h, "new lonely", 20)
+
+	const target = "/admin/purge_inactive?older_than=2024-03-02T00:00:00Z"
+	rec := do(t, h, http.MethodPost, target+"&dry_run=true", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[purgeResult](t, rec); !got.DryRun || got.Count != 1 || !slices.Equal(got.IDs, []string{oldLonely}) {
+		t.Errorf("dry run = %+v, want only %s", got, oldLonely)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+oldLonely, ""), http.StatusOK)
+
+	rec = do(t, h, http.MethodPost, target, "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[purgeResult](t, rec); got.DryRun || !slices.Equal(got.IDs, []string{oldLonely}) {
+		t.Errorf("purge = %+v, want only %s", got, oldLonely)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+oldLonely, ""), http.StatusNotFound)
+	for _, id := range []string{oldFriend, oldFriend2, newLonely} {
+		expectStatus(t, do(t, h, http.MethodGet, "/user/"+id, ""), http.StatusOK)
+	}
+
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/purge_inactive", "", admin...), http.StatusBadRequest)
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/purge_inactive?older_than=soon", "", admin...), http.StatusBadRequest)
+	expectStatus(t, do(t, h, http.MethodPost, target, ""), http.StatusUnauthorized)
+}
+
+func TestValidateReportsEachViolation(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+
+	rec := do(t, h, http.MethodGet, "/admin/validate", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	if report := decodeResponse[integrityReport](t, rec); !report.Valid || len(report.Violations) != 0 {
+		t.Errorf("empty store report = %+v", report)
+	}
+
+	seedUsers(t, map[string]User{
+		"1": {Name: "a", Friends: friendsOf("1", "2", "2")},
+		"2": {Name: "b", Friends: friendsOf("1", "3")},
+		"3": {Name: "c", Friends: friendsOf("99")},
+	})
+
+	report := decodeResponse[integrityReport](t, do(t, h, http.MethodGet, "/admin/validate", "", admin...))
+	want := []integrityViolation{
+		{"self_loop", "1", "1"},
+		{"duplicate_friend", "1", "2"},
+		{"asymmetric_edge", "2", "3"},
+		{"dangling_reference", "3", "99"},
+	}
+	if report.Valid || !slices.Equal(report.Violations, want) {
+		t.Errorf("violations = %+v, want %+v", report.Violations, want)
+	}
+	for _, v := range want {
+		if report.Counts[v.Kind] != 1 {
+			t.Errorf("count of %s = %d, want 1", v.Kind, report.Counts[v.Kind])
+		}
+	}
+
+	// Validation only reports.
+	user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/1", ""))
+	if len(user.Friends) != 3 {
+		t.Errorf("friends of 1 = %v after validation", user.Friends)
+	}
+}
+
+func TestMaintenanceBlocksWritesOnly(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+	a := createUser(t, h, "a", 20)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/maintenance?enabled=true", "", admin...), http.StatusOK)
+
+	for _, write := range []struct{ method, target, body string }{
+		{http.MethodPost, "/create", `{"name":"b","age":20}`},
+		{http.MethodPut, "/user_age/" + a, `{"new_age":21}`},
+		{http.MethodDelete, "/user", `{"target_id":"` + a + `"}`},
+	} {
+		rec := do(t, h, write.method, write.target, write.body)
+		expectStatus(t, rec, http.StatusServiceUnavailable)
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s %s: no Retry-After", write.method, write.target)
+		}
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/users", ""), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+a, ""), http.StatusOK)
+
+	rpc := decodeResponse[rpcReply](t, do(t, h, http.MethodPost, "/rpc", `{"jsonrpc":"2.0","method":"createUser","params":{"name":"b","age":20},"id":1}`))
+	if rpc.Error == nil || rpc.Error.Code != rpcUnavailable {
+		t.Errorf("RPC write during maintenance = %+v", rpc)
+	}
+
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/maintenance?enabled=false", "", admin...), http.StatusOK)
+	createUser(t, h, "b", 20)
+	if age := userAge(t, h, a); age != 20 {
+		t.Errorf("age changed to %d during maintenance", age)
+	}
+}
+
+func TestOrphanEdges(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+	captureLog(t)
+
+	seedUsers(t, map[string]User{
+		"1": {Name: "a", Friends: friendsOf("2", "98", "99")},
+		"2": {Name: "b", Friends: friendsOf("1")},
+		"3": {Name: "c", Friends: friendsOf("98")},
+	})
+
+	type orphanReport struct {
+		Count   int                 `json:"count"`
+		Orphans map[string][]string `json:"orphans"`
+	}
+	check := func(method string) {
+		t.Helper()
+		rec := do(t, h, method, "/admin/orphan_edges", "", admin...)
+		expectStatus(t, rec, http.StatusOK)
+		got := decodeResponse[orphanReport](t, rec)
+		if got.Count != 3 || len(got.Orphans) != 2 ||
+			!slices.Equal(got.Orphans["1"], []string{"98", "99"}) || !slices.Equal(got.Orphans["3"], []string{"98"}) {
+			t.Errorf("%s: report = %+v", method, got)
+		}
+	}
+	check(http.MethodGet)
+	check(http.MethodGet) // reporting leaves them in place
+	check(http.MethodDelete)
+
+	got := decodeResponse[orphanReport](t, do(t, h, http.MethodGet, "/admin/orphan_edges", "", admin...))
+	if got.Count != 0 || len(got.Orphans) != 0 {
+		t.Errorf("after cleanup: %+v", got)
+	}
+	if user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/1", "")); !slices.Equal(user.Friends, []string{"2"}) {
+		t.Errorf("friends of 1 = %v, want the real friend kept", user.Friends)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// blocks reports whether either of a and b has blocked the other.
+// The caller must hold usersMutex.
+func blocks(a, b string) bool {
+	return slices.Contains(users[a].Blocked, b) || slices.Contains(users[b].Blocked, a)
+}
+
+// blockUserHandler puts target_id on user_id's block list and ends their
+// friendship, if any. Blocking twice is not an error.
+func blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	params, qerr := pathParams(r, "user_id", "target_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	userID, targetID := params[0], params[1]
+	if userID == targetID {
+		httpError(w, r, http.StatusBadRequest, "self_block")
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	user, userExists := users[userID]
+	if _, targetExists := users[targetID]; !userExists || !targetExists {
+		httpError(w, r, http.StatusNotFound, "users_not_found")
+		return
+	}
+
+	if !slices.Contains(user.Blocked, targetID) {
+		user.Blocked = append(slices.Clone(user.Blocked), targetID)
+		putUser(userID, user)
+	}
+	removeFriendship(userID, targetID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unblockUserHandler takes target_id off user_id's block list. It does not
+// restore a friendship the block ended.
+func unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	params, qerr := pathParams(r, "user_id", "target_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	userID, targetID := params[0], params[1]
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	if i := slices.Index(user.Blocked, targetID); i >= 0 {
+		user.Blocked = slices.Delete(slices.Clone(user.Blocked), i, i+1)
+		putUser(userID, user)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBlockedUsersCannotBefriend(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 20)
+	makeFriends(t, h, a, b)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/user/"+a+"/block/"+b, ""), http.StatusNoContent)
+	if user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+b, "")); len(user.Friends) != 0 {
+		t.Errorf("block kept the friendship: friends of %s = %v", b, user.Friends)
+	}
+
+	// Neither side can start the friendship again, over REST or RPC.
+	for _, body := range []string{`{"source_id":"` + b + `","target_id":"` + a + `"}`, `{"source_id":"` + a + `","target_id":"` + b + `"}`} {
+		expectStatus(t, do(t, h, http.MethodPost, "/make_friends", body), http.StatusConflict)
+	}
+	reply := decodeResponse[rpcReply](t, do(t, h, http.MethodPost, "/rpc",
+		`{"jsonrpc":"2.0","method":"makeFriends","params":{"source_id":"`+b+`","target_id":"`+a+`"},"id":1}`))
+	if reply.Error == nil || reply.Error.Code != rpcConflict {
+		t.Errorf("RPC makeFriends = %+v, want error %d", reply, rpcConflict)
+	}
+
+	expectStatus(t, do(t, h, http.MethodDelete, "/user/"+a+"/block/"+b, ""), http.StatusNoContent)
+	makeFriends(t, h, b, a)
+}
+
+func TestReplaceFriendsRejectsBlocked(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b, c := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20)
+	makeFriends(t, h, a, c)
+	expectStatus(t, do(t, h, http.MethodPost, "/user/"+b+"/block/"+a, ""), http.StatusNoContent)
+
+	rec := do(t, h, http.MethodPut, "/friends/"+a, `{"friend_ids":["`+b+`"]}`)
+	expectStatus(t, rec, http.StatusConflict)
+	if !strings.Contains(rec.Body.String(), b) {
+		t.Errorf("error does not name %s: %s", b, rec.Body)
+	}
+	if user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+a, "")); !sameIDs(user.Friends, []string{c}) {
+		t.Errorf("friends of %s = %v, want them untouched", a, user.Friends)
+	}
+}
+
+func TestMergeSkipsBlockedFriends(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b, c, d := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20), createUser(t, h, "d", 20)
+	makeFriends(t, h, c, a, c, d)
+	expectStatus(t, do(t, h, http.MethodPost, "/user/"+a+"/block/"+b, ""), http.StatusNoContent)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/users/"+c+"/merge_into/"+b, ""), http.StatusOK)
+
+	if user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+b, "")); !sameIDs(user.Friends, []string{d}) {
+		t.Errorf("friends of %s = %v, want only [%s]", b, user.Friends, d)
+	}
+	if user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+a, "")); len(user.Friends) != 0 {
+		t.Errorf("%s befriended through a merge: %v", a, user.Friends)
+	}
+}
+
+func TestRecommendationsSkipBlocked(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	me, friend, fof, other := createUser(t, h, "me", 20), createUser(t, h, "friend", 20), createUser(t, h, "fof", 20), createUser(t, h, "other", 20)
+	makeFriends(t, h, me, friend, friend, fof, friend, other)
+
+	recommended := func() []string {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/recommendations/"+me, "")
+		expectStatus(t, rec, http.StatusOK)
+		return responseIDs(t, rec)
+	}
+	if got := recommended(); !sameIDs(got, []string{fof, other}) {
+		t.Fatalf("recommendations = %v, want [%s %s]", got, fof, other)
+	}
+
+	expectStatus(t, do(t, h, http.MethodPost, "/user/"+me+"/block/"+fof, ""), http.StatusNoContent)
+	if got := recommended(); !sameIDs(got, []string{other}) {
+		t.Errorf("after blocking %s: recommendations = %v", fof, got)
+	}
+
+	// Being blocked hides the blocker too.
+	expectStatus(t, do(t, h, http.MethodPost, "/user/"+other+"/block/"+me, ""), http.StatusNoContent)
+	if got := recommended(); len(got) != 0 {
+		t.Errorf("after being blocked by %s: recommendations = %v", other, got)
+	}
+}
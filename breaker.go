@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// UserStore is the backend user reads go through. The in-process map never
+// fails, but a networked backend would, and storeBreaker keeps its
+// failures from piling up requests.
+type UserStore interface {
+	GetUser(id string) (User, bool, error)
+}
+
+// memoryStore reads the in-process map. The caller must hold usersMutex.
+type memoryStore struct{}
+
+func (memoryStore) GetUser(id string) (User, bool, error) {
+	user, ok := users[id]
+	return user, ok, nil
+}
+
+// userStore is the store handlers read users from.
+var userStore UserStore = &storeBreaker{store: memoryStore{}}
+
+// errStoreUnavailable is returned without calling the store while the
+// breaker is open.
+var errStoreUnavailable = errors.New("store unavailable: circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = []string{"closed", "open", "half_open"}
+
+func (s breakerState) String() string { return breakerStateNames[s] }
+
+// storeBreaker is a circuit breaker around a UserStore. It opens after
+// config.StoreBreakerThreshold consecutive errors and then fails every call
+// with errStoreUnavailable. After config.StoreBreakerCooldown it lets a
+// single probe through: success closes it again, failure reopens it for
+// another cooldown.
+type storeBreaker struct {
+	store UserStore
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	rejected int64
+}
+
+func (b *storeBreaker) GetUser(id string) (User, bool, error) {
+	if !b.allow() {
+		return User{}, false, errStoreUnavailable
+	}
+	user, ok, err := b.store.GetUser(id)
+	b.record(err)
+	return user, ok, err
+}
+
+// allow reports whether a call may reach the store, moving an open breaker
+// whose cooldown is over to half-open for the one probe.
+func (b *storeBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if clock().Sub(b.openedAt) >= time.Duration(config.StoreBreakerCooldown) {
+			b.setState(breakerHalfOpen)
+			return true
+		}
+	case breakerHalfOpen:
+		// The probe is still out.
+	default:
+		return true
+	}
+	b.rejected++
+	return false
+}
+
+func (b *storeBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= config.StoreBreakerThreshold {
+		b.openedAt = clock()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState logs every transition. The caller must hold b.mu.
+func (b *storeBreaker) setState(state breakerState) {
+	if state != b.state {
+		log.Printf("store circuit breaker %s -> %s", b.state, state)
+	}
+	b.state = state
+}
+
+// snapshot returns the state and the number of calls rejected so far.
+func (b *storeBreaker) snapshot() (breakerState, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.rejected
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyStore fails while down is set and counts the calls that reach it.
+type flakyStore struct {
+	down  bool
+	calls int
+}
+
+func (s *flakyStore) GetUser(id string) (User, bool, error) {
+	s.calls++
+	if s.down {
+		return User{}, false, errors.New("backend down")
+	}
+	return memoryStore{}.GetUser(id)
+}
+
+func TestStoreBreaker(t *testing.T) {
+	resetState(t)
+	fake := useFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	config.StoreBreakerThreshold = 2
+	config.StoreBreakerCooldown = duration(time.Minute)
+	backend := &flakyStore{down: true}
+	saved := userStore
+	userStore = &storeBreaker{store: backend}
+	t.Cleanup(func() { userStore = saved })
+	h := newRouter()
+	id := createUser(t, h, "a", 20)
+
+	expectBreaker := func(want string) {
+		t.Helper()
+		body := do(t, h, http.MethodGet, "/metrics", "").Body.String()
+		if line := `store_breaker_state{state="` + want + `"} 1`; !strings.Contains(body, line) {
+			t.Errorf("metrics lack %s:\n%s", line, body)
+		}
+	}
+
+	for range 2 {
+		expectStatus(t, do(t, h, http.MethodGet, "/user/"+id, ""), http.StatusServiceUnavailable)
+	}
+	expectBreaker("open")
+
+	// Open: requests fail fast and the store is left alone.
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+id, ""), http.StatusServiceUnavailable)
+	if backend.calls != 2 {
+		t.Errorf("store called %d times, want 2", backend.calls)
+	}
+	if body := do(t, h, http.MethodGet, "/metrics", "").Body.String(); !strings.Contains(body, "store_breaker_rejected_total 1") {
+		t.Errorf("metrics lack the rejection:\n%s", body)
+	}
+
+	// A failed probe after the cooldown opens the breaker again.
+	fake.Advance(time.Minute)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+id, ""), http.StatusServiceUnavailable)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+id, ""), http.StatusServiceUnavailable)
+	if backend.calls != 3 {
+		t.Errorf("store called %d times, want 3", backend.calls)
+	}
+	expectBreaker("open")
+
+	// A good probe closes it.
+	backend.down = false
+	fake.Advance(time.Minute)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+id, ""), http.StatusOK)
+	expectBreaker("closed")
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99", ""), http.StatusNotFound)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// duration is a time.Duration read from JSON strings such as "10s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type Config struct {
+	Addr          string `json:"addr"`
+	DefaultLocale string `json:"default_locale"`
+
+	// TLSCertFile and TLSKeyFile switch the listener on Addr to HTTPS.
+	// HTTPRedirectAddr, if set, adds a plaintext listener that 301-redirects
+	// every request to HTTPS. HSTSMaxAge is the Strict-Transport-Security
+	// max-age sent on HTTPS responses (default 180 days, "0s" disables).
+	TLSCertFile      string   `json:"tls_cert_file"`
+	TLSKeyFile       string   `json:"tls_key_file"`
+	HTTPRedirectAddr string   `json:"http_redirect_addr"`
+	HSTSMaxAge       duration `json:"hsts_max_age"`
+
+	// AllowMissingContentType lets write requests without a Content-Type
+	// header through; an explicit non-JSON type is still rejected.
+	AllowMissingContentType bool `json:"allow_missing_content_type"`
+
+	// AdminToken is the bearer token required on /admin routes. Admin
+	// routes are disabled while it is empty.
+	AdminToken string `json:"admin_token"`
+
+	// MaxConcurrentRequests caps in-flight requests; 0 disables the cap.
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// MaxConcurrentGraphRequests caps in-flight graph traversals separately
+	// from MaxConcurrentRequests; 0 disables the cap.
+	MaxConcurrentGraphRequests int `json:"max_concurrent_graph_requests"`
+
+	// MaxURILength caps the length in bytes of the request path plus query
+	// string; longer requests get 414. 0 disables the cap.
+	MaxURILength int `json:"max_uri_length"`
+
+	// Connection timeouts, each disabled by "0s":
+	//   - ReadHeaderTimeout (default 5s) bounds reading the request headers.
+	//   - ReadTimeout (default 30s) bounds reading the whole request.
+	//   - WriteTimeout (default 60s) bounds writing the response, counted
+	//     from the end of the headers; long /users/stream exports need it
+	//     raised.
+	// /users/import and /users/bulk_stream lift ReadTimeout and WriteTimeout
+	// for their own requests, since their bodies are as long as the data.
+	//   - IdleTimeout (default 120s) bounds how long a keep-alive
+	//     connection waits for its next request.
+	ReadHeaderTimeout duration `json:"read_header_timeout"`
+	ReadTimeout       duration `json:"read_timeout"`
+	WriteTimeout      duration `json:"write_timeout"`
+	IdleTimeout       duration `json:"idle_timeout"`
+
+	// RequestTimeout bounds how long a handler may run before the client
+	// gets 503 (default 10s). RouteTimeouts overrides it per route pattern,
+	// as registered in main, e.g. "/graph/metrics": "30s"; "0s" disables
+	// the limit for a route. Entries in the config file are merged into the
+	// defaults, which exempt the streaming and import routes and give graph
+	// analytics 30s.
+	RequestTimeout duration            `json:"request_timeout"`
+	RouteTimeouts  map[string]duration `json:"route_timeouts"`
+
+	// SlowRequestThreshold is the latency above which a request is logged
+	// as slow and counted in /metrics (default 1s, "0s" disables).
+	// SlowRouteThresholds overrides it per route pattern, as RouteTimeouts
+	// does for the timeout; the defaults exempt the streaming and import
+	// routes.
+	SlowRequestThreshold duration            `json:"slow_request_threshold"`
+	SlowRouteThresholds  map[string]duration `json:"slow_route_thresholds"`
+
+	// ShutdownTimeout is how long shutdown waits for in-flight requests
+	// before closing their connections. ShutdownHookTimeout then bounds
+	// each shutdown hook, such as the final snapshot.
+	ShutdownTimeout     duration `json:"shutdown_timeout"`
+	ShutdownHookTimeout duration `json:"shutdown_hook_timeout"`
+
+	// DefaultPageSize is the page size of list endpoints when no limit is
+	// given; larger limits are clamped to MaxPageSize.
+	DefaultPageSize int `json:"default_page_size"`
+	MaxPageSize     int `json:"max_page_size"`
+
+	// CentralitySampleSize is how many source users /graph/central expands
+	// when estimating betweenness.
+	CentralitySampleSize int `json:"centrality_sample_size"`
+
+	// GraphMetricsSampleSize is how many BFS sources /graph/metrics expands
+	// per component before switching from exact to estimated path metrics.
+	GraphMetricsSampleSize int `json:"graph_metrics_sample_size"`
+
+	// LongestChainMaxDepth bounds the hops explored by longest_chain.
+	LongestChainMaxDepth int `json:"longest_chain_max_depth"`
+
+	// MaxSubgraphDepth caps the depth parameter of /user/{id}/subgraph.
+	MaxSubgraphDepth int `json:"max_subgraph_depth"`
+
+	// MaxEmbeddedFriends caps how many friend objects a view embeds, such
+	// as /user/{id}/full; views that hit it set a truncated flag.
+	MaxEmbeddedFriends int `json:"max_embedded_friends"`
+
+	// MaxMatrixUsers is the largest user count /graph/matrix exports; the
+	// matrix has MaxMatrixUsers squared cells, about 2 MB of JSON at the
+	// default of 1000.
+	MaxMatrixUsers int `json:"max_matrix_users"`
+
+	// MaxTriangles caps how many triangles /graph/triangles lists; all of
+	// them are still counted.
+	MaxTriangles int `json:"max_triangles"`
+
+	// LargeResponseBytes logs a warning for every response bigger than it,
+	// to spot clients that forgot to paginate (default 1 MiB). 0 disables
+	// the warning; sizes are still recorded in /metrics.
+	LargeResponseBytes int `json:"large_response_bytes"`
+
+	// RejectDuplicates makes /create answer 409 when a user with the same
+	// name and age exists. Name plus age is only an approximate identity, so
+	// this guards against accidental double submits, not true duplicates.
+	RejectDuplicates bool `json:"reject_duplicates"`
+
+	// CORSAllowedOrigins lists the browser origins allowed to call the API;
+	// "*" allows any and an empty list disables CORS handling.
+	// CORSExposedHeaders are the response headers scripts on those origins
+	// may read.
+	CORSAllowedOrigins []string `json:"cors_allowed_origins"`
+	CORSExposedHeaders []string `json:"cors_exposed_headers"`
+
+	// Features switches route groups off by name (see knownFeatures);
+	// disabled routes answer 404 and missing names are enabled. They are
+	// re-read from the config file on SIGHUP.
+	Features map[string]bool `json:"features"`
+
+	// LogBodies logs the request and response bodies of mutating requests
+	// for debugging, cut to LogBodyLimit bytes each and with emails
+	// masked. Off by default.
+	LogBodies    bool `json:"log_bodies"`
+	LogBodyLimit int  `json:"log_body_limit"`
+
+	// Maintenance starts the service in read-only maintenance mode; it can
+	// be toggled at runtime with POST /admin/maintenance.
+	Maintenance bool `json:"maintenance"`
+
+	// StateFile is a snapshot loaded at startup, if set and present.
+	// SnapshotInterval, if set, also writes the state back to it at that
+	// interval and on shutdown; "0s", the default, disables writing.
+	StateFile        string   `json:"state_file"`
+	SnapshotInterval duration `json:"snapshot_interval"`
+
+	// StoreBreakerThreshold is how many consecutive user store errors open
+	// the circuit breaker (default 5); reads then answer 503 without trying
+	// the store until StoreBreakerCooldown (default 10s) has passed.
+	StoreBreakerThreshold int      `json:"store_breaker_threshold"`
+	StoreBreakerCooldown  duration `json:"store_breaker_cooldown"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Addr:          ":8080",
+		DefaultLocale: "en",
+		HSTSMaxAge:    duration(180 * 24 * time.Hour),
+
+		MaxConcurrentRequests:      256,
+		MaxConcurrentGraphRequests: 8,
+		MaxURILength:               4096,
+		ReadHeaderTimeout:          duration(5 * time.Second),
+		ReadTimeout:                duration(30 * time.Second),
+		WriteTimeout:               duration(60 * time.Second),
+		IdleTimeout:                duration(120 * time.Second),
+		ShutdownTimeout:            duration(10 * time.Second),
+		ShutdownHookTimeout:        duration(5 * time.Second),
+		DefaultPageSize:            50,
+		MaxPageSize:                500,
+		CentralitySampleSize:       64,
+		GraphMetricsSampleSize:     64,
+		LongestChainMaxDepth:       10,
+		MaxSubgraphDepth:           4,
+		MaxEmbeddedFriends:         100,
+		MaxMatrixUsers:             1000,
+		MaxTriangles:               1000,
+		LogBodyLimit:               2048,
+		LargeResponseBytes:         1 << 20,
+		CORSExposedHeaders:         []string{"X-Total-Count", "X-Request-Id"},
+		StoreBreakerThreshold:      5,
+		StoreBreakerCooldown:       duration(10 * time.Second),
+
+		RequestTimeout: duration(10 * time.Second),
+		RouteTimeouts: map[string]duration{
+			"/users/stream":                 0,
+			"/users/import":                 0,
+			"/users/bulk_stream":            0,
+			"/graph/metrics":                duration(30 * time.Second),
+			"/graph/central":                duration(30 * time.Second),
+			"/graph/strong_pairs":           duration(30 * time.Second),
+			"/graph/triangles":              duration(30 * time.Second),
+			"/graph/pagerank":               duration(30 * time.Second),
+			"/user/{user_id}/longest_chain": duration(30 * time.Second),
+		},
+
+		// Streams and imports run as long as the data takes.
+		SlowRequestThreshold: duration(time.Second),
+		SlowRouteThresholds: map[string]duration{
+			"/users/stream":      0,
+			"/users/import":      0,
+			"/users/bulk_stream": 0,
+		},
+	}
+}
+
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if cfg.DefaultPageSize < 1 || cfg.MaxPageSize < cfg.DefaultPageSize {
+		return cfg, fmt.Errorf("page sizes must satisfy 1 <= default_page_size <= max_page_size")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return cfg, fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	if cfg.HTTPRedirectAddr != "" && cfg.TLSCertFile == "" {
+		return cfg, fmt.Errorf("http_redirect_addr requires TLS")
+	}
+	if cfg.ShutdownHookTimeout <= 0 {
+		return cfg, fmt.Errorf("shutdown_hook_timeout must be positive")
+	}
+	if cfg.SnapshotInterval < 0 {
+		return cfg, fmt.Errorf("snapshot_interval must not be negative")
+	}
+	if cfg.SnapshotInterval > 0 && cfg.StateFile == "" {
+		return cfg, fmt.Errorf("snapshot_interval requires state_file")
+	}
+	if cfg.CentralitySampleSize < 1 || cfg.GraphMetricsSampleSize < 1 {
+		return cfg, fmt.Errorf("centrality_sample_size and graph_metrics_sample_size must be positive")
+	}
+	if cfg.MaxSubgraphDepth < 0 {
+		return cfg, fmt.Errorf("max_subgraph_depth must not be negative")
+	}
+	if cfg.MaxEmbeddedFriends < 0 {
+		return cfg, fmt.Errorf("max_embedded_friends must not be negative")
+	}
+	if cfg.LargeResponseBytes < 0 {
+		return cfg, fmt.Errorf("large_response_bytes must not be negative")
+	}
+	if cfg.StoreBreakerThreshold < 1 || cfg.StoreBreakerCooldown <= 0 {
+		return cfg, fmt.Errorf("store_breaker_threshold and store_breaker_cooldown must be positive")
+	}
+	if cfg.LogBodyLimit < 0 {
+		return cfg, fmt.Errorf("log_body_limit must not be negative")
+	}
+	if err := validateFeatures(cfg.Features); err != nil {
+		return cfg, err
+	}
+	if _, ok := messages[cfg.DefaultLocale]; !ok {
+		return cfg, fmt.Errorf("unsupported default_locale %q", cfg.DefaultLocale)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Wire format conventions, shared by every request and response body:
+//   - field names are snake_case;
+//   - IDs are always JSON strings, in requests and responses alike, so
+//     clients never round them through a float64 and lose precision;
+//   - a user's own ID is "id", a reference to another user is "<role>_id"
+//     (source_id, target_id, user_id) and lists of references are
+//     "<role>_ids";
+//   - fields that replace a stored value are prefixed with "new_".
+//
+// The types below are the only ones decoded from or encoded to the API for
+// users; the storage type User is free to change without touching clients.
+
+type createUserRequest struct {
+	Name    string   `json:"name"`
+	Age     int      `json:"age"`
+	Friends []string `json:"friends"`
+	Email   string   `json:"email"`
+}
+
+// schemaVersionHeader selects the user body schema; bodies without it are
+// decoded as defaultSchemaVersion.
+const (
+	schemaVersionHeader  = "X-Schema-Version"
+	defaultSchemaVersion = "1"
+)
+
+// userDecoders decode a user body per schema version: v1 is the original
+// name, age and friends, v2 adds email. Unknown fields are ignored in both,
+// so an email sent as v1 is dropped rather than rejected.
+var userDecoders = map[string]func(io.Reader) (createUserRequest, error){
+	"1": func(body io.Reader) (createUserRequest, error) {
+		var v1 struct {
+			Name    string   `json:"name"`
+			Age     int      `json:"age"`
+			Friends []string `json:"friends"`
+		}
+		err := decodeBody(body, &v1)
+		return createUserRequest{Name: v1.Name, Age: v1.Age, Friends: v1.Friends}, err
+	},
+	"2": func(body io.Reader) (createUserRequest, error) {
+		var v2 createUserRequest
+		err := decodeBody(body, &v2)
+		return v2, err
+	},
+}
+
+// decodeUserRequest decodes and normalizes a user body in the given schema
+// version. On failure it returns the catalog message to reply with.
+func decodeUserRequest(version string, body io.Reader) (createUserRequest, *queryError) {
+	if version == "" {
+		version = defaultSchemaVersion
+	}
+	decode, ok := userDecoders[version]
+	if !ok {
+		return createUserRequest{}, &queryError{id: "schema_version"}
+	}
+	req, err := decode(body)
+	if err != nil {
+		return createUserRequest{}, &queryError{id: "invalid_body"}
+	}
+	if qerr := req.clean(); qerr != nil {
+		return createUserRequest{}, qerr
+	}
+	return req, nil
+}
+
+// clean normalizes req and checks the fields every schema version shares,
+// returning the catalog message for the first problem found. Friend IDs are
+// checked against the store by checkNewUser.
+func (req *createUserRequest) clean() *queryError {
+	if !req.normalize() {
+		return &queryError{id: "name_required"}
+	}
+	if !validAge(req.Age) {
+		return &queryError{id: "age_out_of_range", args: []any{minAge, maxAge}}
+	}
+	if req.Email != "" && !strings.Contains(req.Email, "@") {
+		return &queryError{id: "invalid_email"}
+	}
+	return nil
+}
+
+type friendshipRequest struct {
+	SourceID string `json:"source_id"`
+	TargetID string `json:"target_id"`
+}
+
+type deleteUserRequest struct {
+	TargetID string `json:"target_id"`
+}
+
+// updateAgeRequest carries exactly one of NewAge (absolute) or Delta
+// (relative, clamped to the valid range).
+type updateAgeRequest struct {
+	NewAge *int `json:"new_age"`
+	Delta  *int `json:"delta"`
+}
+
+type weightRequest struct {
+	Weight *int `json:"weight"`
+}
+
+// validate returns the catalog message and arguments describing what is
+// wrong with the request, or an empty ID when it is well formed.
+func (req updateAgeRequest) validate() (string, []any) {
+	if (req.NewAge == nil) == (req.Delta == nil) {
+		return "age_or_delta", nil
+	}
+	if req.NewAge != nil && !validAge(*req.NewAge) {
+		return "age_out_of_range", []any{minAge, maxAge}
+	}
+	return "", nil
+}
+
+type replaceFriendsRequest struct {
+	FriendIDs []string `json:"friend_ids"`
+}
+
+type ageUpdateEntry struct {
+	ID     string `json:"id"`
+	NewAge int    `json:"new_age"`
+}
+
+type userResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Age       int       `json:"age"`
+	Friends   []string  `json:"friends"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Email      string `json:"email,omitempty"`
+	ExternalID string `json:"external_id,omitempty"`
+}
+
+// friendResponse is a friend as listed by /friends/{user_id}, with the
+// weight of the friendship alongside the friend's own record.
+type friendResponse struct {
+	userResponse
+	Weight int `json:"weight"`
+}
+
+// fullUserResponse embeds friend objects in place of the friend ID list.
+type fullUserResponse struct {
+	userResponse
+	Friends          []userResponse `json:"friends"`
+	FriendsTruncated bool           `json:"friends_truncated"`
+}
+
+// normalize trims the name and trims and lowercases the email, so padded or
+// differently cased input cannot create look-alike users that lookups and
+// the duplicate check treat as different. It reports false when nothing is
+// left of the name.
+func (req *createUserRequest) normalize() bool {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	return req.Name != ""
+}
+
+// toUser builds the stored user without friends; storeUser adds the ones
+// given at creation on both sides once the user has an ID.
+func (req createUserRequest) toUser(createdAt time.Time) User {
+	return User{
+		Name:      req.Name,
+		Age:       req.Age,
+		Friends:   []Friend{},
+		Email:     req.Email,
+		CreatedAt: createdAt,
+	}
+}
+
+// toUserResponse copies the friend list so the result can be encoded after
+// usersMutex is released. Friends are listed by ID only, as they always were
+// on the wire; per-friendship details have their own endpoints.
+func toUserResponse(id string, user User) userResponse {
+	return userResponse{
+		ID:        id,
+		Name:      user.Name,
+		Age:       user.Age,
+		Friends:   user.friendIDs(),
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.lastModified(),
+
+		Email:      user.Email,
+		ExternalID: user.ExternalID,
+	}
+}
+
+// anonymizer replaces names with pseudonyms that are stable for a user within
+// one response and drops emails. IDs and friend lists are kept, so the graph
+// shape survives.
+type anonymizer map[string]string
+
+func (a anonymizer) apply(view *userResponse) {
+	name, ok := a[view.ID]
+	if !ok {
+		name = fmt.Sprintf("user-%d", len(a)+1)
+		a[view.ID] = name
+	}
+	view.Name = name
+	view.Email = ""
+}
+
+// parseAnonymize reads the admin-only ?anonymize flag, writing the rejection
+// itself when the value is malformed or the caller is not an admin. It
+// returns a nil anonymizer when output should not be anonymized.
+func parseAnonymize(w http.ResponseWriter, r *http.Request) (anonymizer, bool) {
+	anonymize, qerr := parseBoolParam(r.URL.Query(), "anonymize", false)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return nil, false
+	}
+	if !anonymize {
+		return nil, true
+	}
+	if !checkAdmin(w, r) {
+		return nil, false
+	}
+	return anonymizer{}, true
+}
+
+// userFields are the userResponse keys ?fields may select.
+var userFields = map[string]bool{
+	"id": true, "name": true, "age": true, "friends": true, "created_at": true,
+	"updated_at": true, "email": true, "external_id": true,
+}
+
+// fieldSet is a ?fields selection; nil means every field is returned.
+type fieldSet map[string]bool
+
+func parseFields(q url.Values) (fieldSet, *queryError) {
+	v := q.Get("fields")
+	if v == "" {
+		return nil, nil
+	}
+	fields := fieldSet{}
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if !userFields[name] {
+			return nil, &queryError{id: "unknown_field", args: []any{name}}
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+// project trims view down to the selected fields by round-tripping it
+// through a JSON object, so the kept keys are exactly the encoded ones.
+func (f fieldSet) project(view userResponse) any {
+	if f == nil {
+		return view
+	}
+	data, err := json.Marshal(view)
+	if err != nil {
+		return view
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return view
+	}
+	for key := range obj {
+		if !f[key] {
+			delete(obj, key)
+		}
+	}
+	return obj
+}
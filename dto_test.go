@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserResponseWireFormat(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	user := User{
+		Name:       "Alice",
+		Age:        30,
+		Friends:    []Friend{{ID: "2", Since: created, Weight: 3}},
+		Email:      "alice@example.com",
+		ExternalID: "ext-1",
+		CreatedAt:  created,
+		UpdatedAt:  created.Add(time.Hour),
+	}
+
+	got, err := json.Marshal(toUserResponse("1", user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":"1","name":"Alice","age":30,"friends":["2"],` +
+		`"created_at":"2024-03-01T12:00:00Z","updated_at":"2024-03-01T13:00:00Z",` +
+		`"email":"alice@example.com","external_id":"ext-1"}`
+	if string(got) != want {
+		t.Errorf("wire format changed:\n got %s\nwant %s", got, want)
+	}
+
+	got, _ = json.Marshal(toUserResponse("1", User{Name: "Bob", CreatedAt: created}))
+	if strings.Contains(string(got), "email") || strings.Contains(string(got), "external_id") {
+		t.Errorf("empty optional fields are encoded: %s", got)
+	}
+	if !strings.Contains(string(got), `"friends":[]`) {
+		t.Errorf("no friends is not an empty array: %s", got)
+	}
+}
+
+func TestRequestWireFormat(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	// The documented request field names, end to end.
+	expectStatus(t, do(t, h, http.MethodPost, "/create", `{"name":"a","age":20}`), http.StatusCreated)
+	expectStatus(t, do(t, h, http.MethodPost, "/create", `{"name":"b","age":20}`), http.StatusCreated)
+	expectStatus(t, do(t, h, http.MethodPost, "/make_friends", `{"source_id":"1","target_id":"2"}`), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodPut, "/user_age/1", `{"new_age":21}`), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodPut, "/friends/1", `{"friend_ids":["2"]}`), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":"2"}`), http.StatusNoContent)
+
+	// IDs are strings; a numeric one is rejected, not coerced.
+	expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":1}`), http.StatusBadRequest)
+
+	user := decodeResponse[map[string]any](t, do(t, h, http.MethodGet, "/user/1", ""))
+	for _, key := range []string{"id", "name", "age", "friends", "created_at", "updated_at"} {
+		if _, ok := user[key]; !ok {
+			t.Errorf("response lacks %q: %v", key, user)
+		}
+	}
+	if user["id"] != "1" || user["age"] != 21.0 {
+		t.Errorf("user = %v", user)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+
+	seedUsers(t, map[string]User{
+		"1": {Name: "Alice", Email: "alice@example.com", Friends: friendsOf("2", "3")},
+		"2": {Name: "Bob", Email: "bob@example.com", Friends: friendsOf("1")},
+		"3": {Name: "Alice", Email: "alice2@example.com", Friends: friendsOf("1")},
+	})
+
+	rec := do(t, h, http.MethodGet, "/users?order=registration&anonymize=true", "", admin...)
+	expectStatus(t, rec, http.StatusOK)
+	if strings.Contains(rec.Body.String(), "@") {
+		t.Errorf("anonymized listing has an email: %s", rec.Body)
+	}
+	listing := decodeResponse[[]userResponse](t, rec)
+	if len(listing) != 3 {
+		t.Fatalf("listing = %+v, want 3 users", listing)
+	}
+	seen := make(map[string]string)
+	for _, view := range listing {
+		if view.Name == "Alice" || view.Name == "Bob" || view.Name == "" {
+			t.Errorf("user %s keeps name %q", view.ID, view.Name)
+		}
+		if other, ok := seen[view.Name]; ok {
+			t.Errorf("users %s and %s share pseudonym %q", other, view.ID, view.Name)
+		}
+		seen[view.Name] = view.ID
+	}
+	if !sameIDs(listing[0].Friends, []string{"2", "3"}) {
+		t.Errorf("friends of 1 = %v, want [2 3]", listing[0].Friends)
+	}
+
+	// The same request names users the same way; stored data is untouched.
+	again := decodeResponse[[]userResponse](t, do(t, h, http.MethodGet, "/users?order=registration&anonymize=true", "", admin...))
+	for i := range listing {
+		if again[i].Name != listing[i].Name {
+			t.Errorf("user %s is %q, then %q", listing[i].ID, listing[i].Name, again[i].Name)
+		}
+	}
+	user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/1", ""))
+	if user.Name != "Alice" || user.Email != "alice@example.com" {
+		t.Errorf("stored user changed: %+v", user)
+	}
+
+	user = decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/2?anonymize=true", "", admin...))
+	if user.Name == "Bob" || user.Email != "" || !sameIDs(user.Friends, []string{"1"}) {
+		t.Errorf("anonymized user = %+v", user)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/users?anonymize=true", ""), http.StatusUnauthorized)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/1?anonymize=true", ""), http.StatusUnauthorized)
+}
+
+func TestFields(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	id := createUser(t, h, "a", 20)
+
+	user := decodeResponse[map[string]any](t, do(t, h, http.MethodGet, "/user/"+id+"?fields=name,age", ""))
+	if len(user) != 2 || user["name"] != "a" || user["age"] != 20.0 {
+		t.Errorf("user = %v, want only name and age", user)
+	}
+
+	listing := decodeResponse[map[string]map[string]any](t, do(t, h, http.MethodGet, "/users?fields=id", ""))
+	if len(listing) != 1 || len(listing[id]) != 1 || listing[id]["id"] != id {
+		t.Errorf("listing = %v, want only ids", listing)
+	}
+
+	for _, target := range []string{"/user/" + id + "?fields=name,password", "/users?fields=password"} {
+		rec := do(t, h, http.MethodGet, target, "")
+		expectStatus(t, rec, http.StatusBadRequest)
+		if !strings.Contains(rec.Body.String(), "password") {
+			t.Errorf("%s: error does not name the field: %s", target, rec.Body)
+		}
+	}
+}
+
+func TestInputIsTrimmed(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	rec := do(t, h, http.MethodPost, "/create", `{"name":"  Alice \t","age":30,"email":" Alice@Example.COM "}`, schemaVersionHeader, "2")
+	expectStatus(t, rec, http.StatusCreated)
+	id := strings.TrimPrefix(rec.Body.String(), "User ID: ")
+
+	user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+id, ""))
+	if user.Name != "Alice" || user.Email != "alice@example.com" {
+		t.Errorf("stored name %q and email %q, want them trimmed and the email lowercased", user.Name, user.Email)
+	}
+
+	rec = do(t, h, http.MethodPut, "/users/by_external/x", `{"name":" Bob ","age":30}`)
+	expectStatus(t, rec, http.StatusCreated)
+	if user := decodeResponse[userResponse](t, rec); user.Name != "Bob" {
+		t.Errorf("upserted name = %q, want %q", user.Name, "Bob")
+	}
+	rec = do(t, h, http.MethodPut, "/users/by_external/x", `{"name":"  Rob","age":30}`)
+	expectStatus(t, rec, http.StatusOK)
+	if user := decodeResponse[userResponse](t, rec); user.Name != "Rob" {
+		t.Errorf("renamed to %q, want %q", user.Name, "Rob")
+	}
+
+	for _, body := range []string{`{"name":"   ","age":30}`, `{"name":"","age":30}`} {
+		expectStatus(t, do(t, h, http.MethodPost, "/create", body), http.StatusBadRequest)
+	}
+}
+
+func TestDecodeUserRequestVersions(t *testing.T) {
+	const body = `{"name":"a","age":20,"friends":["2"],"email":"a@example.com"}`
+
+	tests := []struct {
+		version string
+		want    createUserRequest
+	}{
+		{"", createUserRequest{Name: "a", Age: 20, Friends: []string{"2"}}},
+		{"1", createUserRequest{Name: "a", Age: 20, Friends: []string{"2"}}},
+		{"2", createUserRequest{Name: "a", Age: 20, Friends: []string{"2"}, Email: "a@example.com"}},
+	}
+	for _, tt := range tests {
+		got, qerr := decodeUserRequest(tt.version, strings.NewReader(body))
+		if qerr != nil || got.Name != tt.want.Name || got.Age != tt.want.Age ||
+			!slices.Equal(got.Friends, tt.want.Friends) || got.Email != tt.want.Email {
+			t.Errorf("version %q: got %+v, %v; want %+v", tt.version, got, qerr, tt.want)
+		}
+	}
+
+	if _, qerr := decodeUserRequest("3", strings.NewReader(body)); qerr == nil || qerr.id != "schema_version" {
+		t.Errorf("version 3: error %v, want schema_version", qerr)
+	}
+	if _, qerr := decodeUserRequest("2", strings.NewReader(`{"name":"a","age":20,"email":"nope"}`)); qerr == nil || qerr.id != "invalid_email" {
+		t.Errorf("v2 bad email: error %v, want invalid_email", qerr)
+	}
+	if _, qerr := decodeUserRequest("", strings.NewReader(`{"name":"a","age":-1}`)); qerr == nil || qerr.id != "age_out_of_range" {
+		t.Errorf("negative age: error %v, want age_out_of_range", qerr)
+	}
+}
+
+func TestSchemaVersionHeader(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	const body = `{"name":"a","age":20,"email":"a@example.com"}`
+
+	rec := do(t, h, http.MethodPost, "/create", body, schemaVersionHeader, "2")
+	expectStatus(t, rec, http.StatusCreated)
+	v2 := strings.TrimPrefix(rec.Body.String(), "User ID: ")
+	rec = do(t, h, http.MethodPost, "/create", body, schemaVersionHeader, "1")
+	expectStatus(t, rec, http.StatusCreated)
+	v1 := strings.TrimPrefix(rec.Body.String(), "User ID: ")
+
+	if user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+v2, "")); user.Email != "a@example.com" {
+		t.Errorf("v2 user email = %q", user.Email)
+	}
+	if user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+v1, "")); user.Email != "" {
+		t.Errorf("v1 user email = %q", user.Email)
+	}
+
+	expectStatus(t, do(t, h, http.MethodPost, "/create", body, schemaVersionHeader, "9"), http.StatusBadRequest)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// knownFeatures are the route groups that config.Features can switch off.
+var knownFeatures = map[string]bool{
+	"graph_analytics": true,
+	"recommendations": true,
+	"stream":          true,
+	"sample":          true,
+}
+
+// featureFlags holds the current config.Features. It is swapped as a whole on
+// reload, so handlers never see a half-updated map.
+var featureFlags atomic.Pointer[map[string]bool]
+
+func validateFeatures(flags map[string]bool) error {
+	for name := range flags {
+		if !knownFeatures[name] {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+	}
+	return nil
+}
+
+func setFeatures(flags map[string]bool) {
+	featureFlags.Store(&flags)
+}
+
+// featureEnabled reports whether name is on; features missing from the
+// config are enabled.
+func featureEnabled(name string) bool {
+	flags := featureFlags.Load()
+	if flags == nil {
+		return true
+	}
+	enabled, ok := (*flags)[name]
+	return !ok || enabled
+}
+
+// requireFeature answers 404 on the routes it guards while name is disabled,
+// as if they did not exist.
+func requireFeature(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !featureEnabled(name) {
+				httpError(w, r, http.StatusNotFound, "not_found")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// reloadFeaturesOnHUP re-reads the config file on SIGHUP and applies its
+// feature flags. Other settings need a restart. A config that fails to load
+// is logged and the current flags are kept.
+func reloadFeaturesOnHUP(path string) {
+	if path == "" {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg, err := loadConfig(path)
+			if err != nil {
+				log.Printf("reload features: %v", err)
+				continue
+			}
+			setFeatures(cfg.Features)
+			log.Printf("reloaded feature flags from %s", path)
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDisabledFeatureIsNotFound(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	createUser(t, h, "a", 20)
+
+	setFeatures(map[string]bool{"graph_analytics": false, "sample": true})
+	expectStatus(t, do(t, h, http.MethodGet, "/graph/metrics", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/1/exactly/0", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodGet, "/users/sample", ""), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/1", ""), http.StatusOK)
+
+	// Flags apply to the running router, as a reload would swap them.
+	setFeatures(map[string]bool{"graph_analytics": true})
+	expectStatus(t, do(t, h, http.MethodGet, "/graph/metrics", ""), http.StatusOK)
+}
+
+func TestLoadConfigRejectsUnknownFeature(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"features":{"time_travel":false}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Error("config with an unknown feature loaded")
+	}
+}
@@ -0,0 +1,1047 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type edge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// lessID orders numeric user IDs by value, so "2" sorts before "10", and
+// puts them before all other IDs, which compare as strings. Numeric ties
+// such as "7" and "07" also fall back to strings, keeping the order total
+// for sort.Search.
+func lessID(a, b string) bool {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil && an != bn:
+		return an < bn
+	case (aErr == nil) != (bErr == nil):
+		return aErr == nil
+	}
+	return a < b
+}
+
+func sortIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+}
+
+// graphEdges returns every friendship once with Source < Target.
+// The caller must hold usersMutex.
+func graphEdges() []edge {
+	return inducedEdges(nil)
+}
+
+// inducedEdges returns, once each and with Source < Target, the friendships
+// whose both ends are in nodes; a nil nodes set means every user. Self-loops
+// and references to missing users, which only damaged state can hold, are
+// left out. The caller must hold usersMutex.
+func inducedEdges(nodes map[string]bool) []edge {
+	edges := []edge{}
+	seen := make(map[edge]bool)
+
+	for id, user := range users {
+		if nodes != nil && !nodes[id] {
+			continue
+		}
+		for _, friendID := range user.friendIDs() {
+			if nodes != nil && !nodes[friendID] {
+				continue
+			}
+			if _, ok := users[friendID]; !ok {
+				continue
+			}
+			e := edge{Source: id, Target: friendID}
+			if lessID(friendID, id) {
+				e = edge{Source: friendID, Target: id}
+			}
+			if e.Source == e.Target || seen[e] {
+				continue
+			}
+			seen[e] = true
+			edges = append(edges, e)
+		}
+	}
+
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Source != edges[j].Source {
+			return lessID(edges[i].Source, edges[j].Source)
+		}
+		return lessID(edges[i].Target, edges[j].Target)
+	})
+	return edges
+}
+
+// bfs walks the users reachable from start in breadth-first order, calling
+// visit for each with its hop distance and the user it was first reached from
+// (empty for start). Traversal stops expanding at maxDepth; a negative
+// maxDepth means no limit. Each user is visited at most once, so dense graphs
+// cost O(V+E). The caller must hold usersMutex.
+func bfs(start string, maxDepth int, visit func(id string, depth int, parent string)) {
+	dist := map[string]int{start: 0}
+	queue := []string{start}
+	visit(start, 0, "")
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if maxDepth >= 0 && dist[id] >= maxDepth {
+			continue
+		}
+		for _, friend := range users[id].Friends {
+			friendID := friend.ID
+			if _, visited := dist[friendID]; visited {
+				continue
+			}
+			if _, ok := users[friendID]; !ok {
+				continue
+			}
+			dist[friendID] = dist[id] + 1
+			queue = append(queue, friendID)
+			visit(friendID, dist[friendID], id)
+		}
+	}
+}
+
+// bfsDistances returns the hop distance from start to every user reachable
+// within maxDepth, start itself included at distance 0.
+// The caller must hold usersMutex.
+func bfsDistances(start string, maxDepth int) map[string]int {
+	dist := make(map[string]int)
+	bfs(start, maxDepth, func(id string, depth int, _ string) { dist[id] = depth })
+	return dist
+}
+
+func getUserReachHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	if _, exists := users[userID]; !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID string `json:"user_id"`
+		Reach  int    `json:"reach"`
+	}{userID, len(bfsDistances(userID, -1)) - 1})
+}
+
+func getGraphEdgesHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	edges := graphEdges()
+	usersMutex.RUnlock()
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Count int    `json:"count"`
+		Edges []edge `json:"edges"`
+	}{len(edges), edges})
+}
+
+// getEdgeCountHandler counts friendships the way /graph/edges lists them.
+func getEdgeCountHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	count := len(graphEdges())
+	usersMutex.RUnlock()
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Edges int `json:"edges"`
+	}{count})
+}
+
+// getDegreeDistributionHandler counts users per number of friends, keyed
+// by degree, along with the average and highest degree. A user's degree is
+// its number of edges in /graph/edges, so repeated, dangling and self
+// entries do not count and the degrees sum to twice /graph/edge_count. An
+// empty graph has an empty distribution and zero averages.
+func getDegreeDistributionHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	degrees := make(map[string]int, len(users))
+	for _, e := range graphEdges() {
+		degrees[e.Source]++
+		degrees[e.Target]++
+	}
+	distribution := make(map[int]int)
+	total, highest := 0, 0
+	for id := range users {
+		degree := degrees[id]
+		distribution[degree]++
+		total += degree
+		highest = max(highest, degree)
+	}
+	count := len(users)
+	usersMutex.RUnlock()
+
+	average := 0.0
+	if count > 0 {
+		average = float64(total) / float64(count)
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Users         int         `json:"users"`
+		AverageDegree float64     `json:"average_degree"`
+		MaxDegree     int         `json:"max_degree"`
+		Distribution  map[int]int `json:"distribution"`
+	}{count, average, highest, distribution})
+}
+
+type strongPair struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Mutual int    `json:"mutual"`
+}
+
+// getStrongPairsHandler lists user pairs sharing at least min_mutual friends.
+// Every user contributes each pair of its own friends once, so the cost is
+// O(sum of squared degrees) time and memory for the pair counts, which grows
+// quickly around hubs; the response is paginated.
+func getStrongPairsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	minMutual, qerr := parseIntParam(q, "min_mutual", 1, 1)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	counts := make(map[edge]int)
+	for id, user := range users {
+		friends := user.friendIDs()
+		for i, a := range friends {
+			for _, b := range friends[i+1:] {
+				if a == b || a == id || b == id {
+					continue
+				}
+				e := edge{Source: a, Target: b}
+				if lessID(b, a) {
+					e = edge{Source: b, Target: a}
+				}
+				counts[e]++
+			}
+		}
+	}
+	usersMutex.RUnlock()
+
+	pairs := []strongPair{}
+	for e, mutual := range counts {
+		if mutual >= minMutual {
+			pairs = append(pairs, strongPair{e.Source, e.Target, mutual})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Mutual != pairs[j].Mutual {
+			return pairs[i].Mutual > pairs[j].Mutual
+		}
+		if pairs[i].Source != pairs[j].Source {
+			return lessID(pairs[i].Source, pairs[j].Source)
+		}
+		return lessID(pairs[i].Target, pairs[j].Target)
+	})
+
+	setTotalCount(w, len(pairs))
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Count int          `json:"count"`
+		Pairs []strongPair `json:"pairs"`
+	}{len(pairs), paginate(pairs, pg)})
+}
+
+type centralUser struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+}
+
+// getCentralUsersHandler ranks users by an approximate betweenness score: the
+// number of times a user sits strictly inside a shortest path between two
+// others. Only config.CentralitySampleSize randomly chosen source users are
+// expanded (all of them on small graphs), and for each source/target pair a
+// single BFS shortest path is counted rather than all of them, so scores are
+// estimates meant for ranking, not exact betweenness values.
+func getCentralUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	seed, qerr := parseIntParam(q, "seed", int(time.Now().UnixNano()), math.MinInt)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	sources := ids
+	if len(ids) > config.CentralitySampleSize {
+		rng := rand.New(rand.NewSource(int64(seed)))
+		sources = make([]string, 0, config.CentralitySampleSize)
+		for _, i := range rng.Perm(len(ids))[:config.CentralitySampleSize] {
+			sources = append(sources, ids[i])
+		}
+	}
+
+	scores := make(map[string]int)
+	for _, source := range sources {
+		parent := make(map[string]string)
+		bfs(source, -1, func(id string, _ int, from string) {
+			parent[id] = from
+			for hop := from; hop != "" && hop != source; hop = parent[hop] {
+				scores[hop]++
+			}
+		})
+	}
+
+	ranked := make([]centralUser, 0, len(ids))
+	for _, id := range ids {
+		ranked = append(ranked, centralUser{id, users[id].Name, scores[id]})
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score > ranked[j].Score })
+	setTotalCount(w, len(ranked))
+
+	writeJSON(w, r, http.StatusOK, struct {
+		SampledSources int           `json:"sampled_sources"`
+		TotalUsers     int           `json:"total_users"`
+		Users          []centralUser `json:"users"`
+	}{len(sources), len(ids), paginate(ranked, pg)})
+}
+
+// PageRank defaults. Iterations stop early once the scores move by less than
+// pageRankTolerance in total between two rounds.
+const (
+	defaultPageRankIterations = 100
+	maxPageRankIterations     = 1000
+	defaultPageRankDamping    = 0.85
+	pageRankTolerance         = 1e-9
+)
+
+type rankedUser struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// pageRank runs power iteration over the friend graph, each friendship
+// counting as a link both ways, and returns the scores, which sum to 1, the
+// number of rounds run and whether they converged. Users without friends
+// spread their score over everyone, as if linked to all users. The caller
+// must hold usersMutex.
+func pageRank(ids []string, iterations int, damping float64) (map[string]float64, int, bool) {
+	n := float64(len(ids))
+	rank := make(map[string]float64, len(ids))
+	for _, id := range ids {
+		rank[id] = 1 / n
+	}
+
+	round := 0
+	for round < iterations {
+		round++
+		dangling := 0.0
+		next := make(map[string]float64, len(ids))
+		for _, id := range ids {
+			friends := []string{}
+			for _, friendID := range users[id].friendIDs() {
+				if _, ok := users[friendID]; ok {
+					friends = append(friends, friendID)
+				}
+			}
+			if len(friends) == 0 {
+				dangling += rank[id]
+				continue
+			}
+			share := rank[id] / float64(len(friends))
+			for _, friendID := range friends {
+				next[friendID] += share
+			}
+		}
+
+		base := (1-damping)/n + damping*dangling/n
+		delta := 0.0
+		for _, id := range ids {
+			next[id] = base + damping*next[id]
+			delta += math.Abs(next[id] - rank[id])
+		}
+		rank = next
+		if delta < pageRankTolerance {
+			return rank, round, true
+		}
+	}
+	return rank, round, false
+}
+
+// getPageRankHandler ranks users by PageRank, highest first, ties going to
+// the smaller ID. ?iterations caps the rounds (default 100, at most 1000)
+// and ?damping is the probability of following a friendship rather than
+// jumping to a random user (default 0.85).
+func getPageRankHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	iterations, qerr := parseIntParam(q, "iterations", defaultPageRankIterations, 1)
+	if qerr != nil || iterations > maxPageRankIterations {
+		writeQueryError(w, r, invalidParam("iterations"))
+		return
+	}
+	damping, qerr := parseFloatParam(q, "damping", defaultPageRankDamping, 0, 1)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	ranked := make([]rankedUser, 0, len(ids))
+	rounds, converged := 0, true
+	if len(ids) > 0 {
+		var scores map[string]float64
+		scores, rounds, converged = pageRank(ids, iterations, damping)
+		for _, id := range ids {
+			ranked = append(ranked, rankedUser{id, users[id].Name, scores[id]})
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score > ranked[j].Score })
+	setTotalCount(w, len(ranked))
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Iterations int          `json:"iterations"`
+		Converged  bool         `json:"converged"`
+		Users      []rankedUser `json:"users"`
+	}{rounds, converged, paginate(ranked, pg)})
+}
+
+// longestChainBudget caps how many path extensions a single longest_chain
+// search may try, on top of the configured depth limit.
+const longestChainBudget = 200_000
+
+// getLongestChainHandler returns the longest simple friendship path starting
+// at the user. The exact problem is NP-hard, so the depth-first search stops
+// at config.LongestChainMaxDepth hops and after longestChainBudget steps; the
+// result is then the longest chain found so far and bounded is true.
+func getLongestChainHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	if _, exists := users[userID]; !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	maxDepth := config.LongestChainMaxDepth
+	steps := 0
+	bounded := false
+	path := []string{userID}
+	best := []string{userID}
+	onPath := map[string]bool{userID: true}
+
+	var extend func()
+	extend = func() {
+		if len(path) > len(best) {
+			best = slices.Clone(path)
+		}
+
+		friends := users[path[len(path)-1]].friendIDs()
+		sortIDs(friends)
+		for _, friendID := range friends {
+			if _, ok := users[friendID]; !ok || onPath[friendID] {
+				continue
+			}
+			if len(path)-1 >= maxDepth || steps >= longestChainBudget {
+				bounded = true
+				return
+			}
+			steps++
+
+			onPath[friendID] = true
+			path = append(path, friendID)
+			extend()
+			path = path[:len(path)-1]
+			delete(onPath, friendID)
+		}
+	}
+	extend()
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID  string   `json:"user_id"`
+		Length  int      `json:"length"`
+		Chain   []string `json:"chain"`
+		Bounded bool     `json:"bounded"`
+	}{userID, len(best) - 1, best, bounded})
+}
+
+// getSubgraphHandler returns every user within depth hops of the given user
+// together with the friendships among them. Depth is clamped to
+// config.MaxSubgraphDepth. Past config.MaxEmbeddedFriends users the farthest
+// ones are left out, truncated is set and only the friendships among the
+// users returned are listed.
+func getSubgraphHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	depth, qerr := parseIntParam(r.URL.Query(), "depth", 2, 0)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	depth = min(depth, config.MaxSubgraphDepth)
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	if _, exists := users[userID]; !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	// bfs visits nearest first, so cutting here keeps the closest users.
+	ids := []string{}
+	bfs(userID, depth, func(id string, _ int, _ string) {
+		ids = append(ids, id)
+	})
+	truncated := len(ids) > config.MaxEmbeddedFriends
+	if truncated {
+		ids = ids[:config.MaxEmbeddedFriends]
+	}
+	nodes, _ := embedFriends(ids)
+
+	members := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		members[node.ID] = true
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID    string         `json:"user_id"`
+		Depth     int            `json:"depth"`
+		Nodes     []userResponse `json:"nodes"`
+		Edges     []edge         `json:"edges"`
+		Truncated bool           `json:"truncated"`
+	}{userID, depth, nodes, inducedEdges(members), truncated})
+}
+
+// getExactDistanceHandler returns the users whose shortest distance from the
+// given user is exactly n hops: the BFS frontier at level n. n=0 yields the
+// user alone, and an n past the edge of the component yields nobody.
+func getExactDistanceHandler(w http.ResponseWriter, r *http.Request) {
+	params, qerr := pathParams(r, "user_id", "n")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	userID := params[0]
+
+	n, err := strconv.Atoi(params[1])
+	if err != nil || n < 0 {
+		writeQueryError(w, r, invalidParam("n"))
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	if _, exists := users[userID]; !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	ids := []string{}
+	bfs(userID, n, func(id string, depth int, _ string) {
+		if depth == n {
+			ids = append(ids, id)
+		}
+	})
+	sortIDs(ids)
+
+	frontier := make([]userResponse, 0, len(ids))
+	for _, id := range ids {
+		frontier = append(frontier, toUserResponse(id, users[id]))
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID   string         `json:"user_id"`
+		Distance int            `json:"distance"`
+		Users    []userResponse `json:"users"`
+	}{userID, n, frontier})
+}
+
+type componentMetrics struct {
+	// Root is the smallest user ID in the component.
+	Root                  string  `json:"root"`
+	Size                  int     `json:"size"`
+	Diameter              int     `json:"diameter"`
+	AveragePathLength     float64 `json:"average_path_length"`
+	ClusteringCoefficient float64 `json:"clustering_coefficient"`
+	// Exact is false when diameter and average path length were estimated
+	// from a sample of BFS sources; the estimated diameter is a lower bound.
+	Exact bool `json:"exact"`
+}
+
+// localClustering is the fraction of pairs of id's friends that are friends
+// themselves; users with fewer than two friends score 0.
+// The caller must hold usersMutex.
+func localClustering(id string) float64 {
+	friends := []string{}
+	for _, friendID := range users[id].friendIDs() {
+		if _, ok := users[friendID]; ok && friendID != id {
+			friends = append(friends, friendID)
+		}
+	}
+	if len(friends) < 2 {
+		return 0
+	}
+
+	links := 0
+	for i, a := range friends {
+		for _, b := range friends[i+1:] {
+			if areFriends(a, b) {
+				links++
+			}
+		}
+	}
+	pairs := len(friends) * (len(friends) - 1) / 2
+	return float64(links) / float64(pairs)
+}
+
+// measureComponent computes the metrics of the component holding members,
+// running BFS from every member, or from config.GraphMetricsSampleSize
+// randomly chosen ones on larger components. The caller must hold usersMutex.
+func measureComponent(members []string, rng *rand.Rand) componentMetrics {
+	m := componentMetrics{Root: members[0], Size: len(members), Exact: true}
+
+	sources := members
+	if len(members) > config.GraphMetricsSampleSize {
+		m.Exact = false
+		sources = make([]string, 0, config.GraphMetricsSampleSize)
+		for _, i := range rng.Perm(len(members))[:config.GraphMetricsSampleSize] {
+			sources = append(sources, members[i])
+		}
+	}
+
+	pathSum, paths := 0, 0
+	for _, source := range sources {
+		for _, d := range bfsDistances(source, -1) {
+			if d == 0 {
+				continue
+			}
+			m.Diameter = max(m.Diameter, d)
+			pathSum += d
+			paths++
+		}
+	}
+	if paths > 0 {
+		m.AveragePathLength = float64(pathSum) / float64(paths)
+	}
+
+	clustering := 0.0
+	for _, id := range members {
+		clustering += localClustering(id)
+	}
+	m.ClusteringCoefficient = clustering / float64(len(members))
+	return m
+}
+
+// getGraphMetricsHandler reports diameter, average shortest path length and
+// average clustering coefficient for each connected component, largest
+// first. The path metrics need a BFS per source, so components larger than
+// config.GraphMetricsSampleSize are estimated from a sample and marked as
+// not exact; ?seed makes the sample reproducible.
+func getGraphMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	seed, qerr := parseIntParam(q, "seed", int(time.Now().UnixNano()), math.MinInt)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	rng := rand.New(rand.NewSource(int64(seed)))
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	seen := make(map[string]bool, len(ids))
+	components := []componentMetrics{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		members := []string{}
+		bfs(id, -1, func(member string, _ int, _ string) {
+			seen[member] = true
+			members = append(members, member)
+		})
+		sortIDs(members)
+		components = append(components, measureComponent(members, rng))
+	}
+	sort.SliceStable(components, func(i, j int) bool { return components[i].Size > components[j].Size })
+
+	exact := true
+	for _, c := range components {
+		exact = exact && c.Exact
+	}
+	setTotalCount(w, len(components))
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Exact      bool               `json:"exact"`
+		Components []componentMetrics `json:"components"`
+	}{exact, paginate(components, pg)})
+}
+
+// getUserClusteringHandler returns the user's local clustering coefficient:
+// the fraction of pairs of its friends that are friends with each other.
+func getUserClusteringHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	if _, exists := users[userID]; !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID     string  `json:"user_id"`
+		Clustering float64 `json:"clustering"`
+	}{userID, localClustering(userID)})
+}
+
+// getUserCliqueHandler returns the friendships among the user's own friends,
+// the edges that localClustering counts, along with the friends they
+// involve, at most config.MaxEmbeddedFriends of them; past the cap only the
+// friendships among the friends returned are listed. The user and friends
+// with no such friendship are left out.
+func getUserCliqueHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	friends := make(map[string]bool, len(user.Friends))
+	for _, friendID := range user.friendIDs() {
+		if _, ok := users[friendID]; ok && friendID != userID {
+			friends[friendID] = true
+		}
+	}
+	edges := inducedEdges(friends)
+
+	involved := make(map[string]bool)
+	for _, e := range edges {
+		involved[e.Source] = true
+		involved[e.Target] = true
+	}
+	ids := make([]string, 0, len(involved))
+	for id := range involved {
+		ids = append(ids, id)
+	}
+	nodes, truncated := embedFriends(ids)
+	if truncated {
+		kept := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			kept[node.ID] = true
+		}
+		edges = slices.DeleteFunc(edges, func(e edge) bool { return !kept[e.Source] || !kept[e.Target] })
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID         string         `json:"user_id"`
+		Users          []userResponse `json:"users"`
+		UsersTruncated bool           `json:"users_truncated"`
+		Edges          []edge         `json:"edges"`
+	}{userID, nodes, truncated, edges})
+}
+
+// mutualFriends returns the existing users on both a's and b's friend lists,
+// sorted. The caller must hold usersMutex.
+func mutualFriends(a, b string) []string {
+	mutual := []string{}
+	for _, friendID := range users[a].friendIDs() {
+		if _, ok := users[friendID]; ok && users[b].hasFriend(friendID) {
+			mutual = append(mutual, friendID)
+		}
+	}
+	sortIDs(mutual)
+	return mutual
+}
+
+// getRelationshipHandler summarizes how two users are connected: both
+// records, whether they are friends, how many friends they share and their
+// hop distance, which is null when they are in different components.
+func getRelationshipHandler(w http.ResponseWriter, r *http.Request) {
+	params, qerr := pathParams(r, "a", "b")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	a, b := params[0], params[1]
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	userA, aExists := users[a]
+	userB, bExists := users[b]
+	if !aExists || !bExists {
+		httpError(w, r, http.StatusNotFound, "users_not_found")
+		return
+	}
+
+	var distance *int
+	if d, ok := bfsDistances(a, -1)[b]; ok {
+		distance = &d
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		A             userResponse `json:"a"`
+		B             userResponse `json:"b"`
+		Friends       bool         `json:"friends"`
+		MutualFriends int          `json:"mutual_friends"`
+		Distance      *int         `json:"distance"`
+	}{toUserResponse(a, userA), toUserResponse(b, userB), areFriends(a, b), len(mutualFriends(a, b)), distance})
+}
+
+// existingFriends counts the friends of id that are still stored. The caller
+// must hold usersMutex.
+func existingFriends(id string) int {
+	count := 0
+	for _, friendID := range users[id].friendIDs() {
+		if _, ok := users[friendID]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+// getSimilarityHandler returns the Jaccard index of two users' friend sets,
+// the share of their combined friends that they have in common. Two users
+// without any friends have a similarity of 0, not 1: nothing in common is
+// taken as no evidence of likeness.
+func getSimilarityHandler(w http.ResponseWriter, r *http.Request) {
+	params, qerr := pathParams(r, "a", "b")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	a, b := params[0], params[1]
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	_, aExists := users[a]
+	_, bExists := users[b]
+	if !aExists || !bExists {
+		httpError(w, r, http.StatusNotFound, "users_not_found")
+		return
+	}
+
+	intersection := len(mutualFriends(a, b))
+	union := existingFriends(a) + existingFriends(b) - intersection
+	similarity := 0.0
+	if union > 0 {
+		similarity = float64(intersection) / float64(union)
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		A            string  `json:"a"`
+		B            string  `json:"b"`
+		Similarity   float64 `json:"similarity"`
+		Intersection int     `json:"intersection"`
+		Union        int     `json:"union"`
+	}{a, b, similarity, intersection, union})
+}
+
+// triangles enumerates every trio of mutual friends once, each sorted by ID,
+// and returns how many there are along with the first limit found. Every
+// edge is oriented from the endpoint of lower degree to the higher one, ties
+// broken by ID, so a triangle is only found from its lowest-ranked corner
+// and hubs are never expanded against each other: O(m^1.5) for m edges.
+// The caller must hold usersMutex.
+func triangles(limit int) (int, [][3]string) {
+	rank := func(a, b string) bool {
+		da, db := len(users[a].Friends), len(users[b].Friends)
+		if da != db {
+			return da < db
+		}
+		return lessID(a, b)
+	}
+
+	out := make(map[string]map[string]bool, len(users))
+	for _, e := range graphEdges() {
+		if _, ok := users[e.Source]; !ok {
+			continue
+		}
+		if _, ok := users[e.Target]; !ok {
+			continue
+		}
+		from, to := e.Source, e.Target
+		if rank(to, from) {
+			from, to = to, from
+		}
+		if out[from] == nil {
+			out[from] = make(map[string]bool)
+		}
+		out[from][to] = true
+	}
+
+	// Walk sources and neighbors in a fixed order so the triangles kept
+	// under the limit are the same on every call.
+	ids := make([]string, 0, len(out))
+	next := make(map[string][]string, len(out))
+	for id, targets := range out {
+		ids = append(ids, id)
+		for to := range targets {
+			next[id] = append(next[id], to)
+		}
+		sortIDs(next[id])
+	}
+	sort.Slice(ids, func(i, j int) bool { return rank(ids[i], ids[j]) })
+
+	count := 0
+	found := [][3]string{}
+	for _, u := range ids {
+		for _, v := range next[u] {
+			for _, w := range next[v] {
+				if !out[u][w] {
+					continue
+				}
+				count++
+				if len(found) < limit {
+					trio := []string{u, v, w}
+					sortIDs(trio)
+					found = append(found, [3]string(trio))
+				}
+			}
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		for k := range found[i] {
+			if found[i][k] != found[j][k] {
+				return lessID(found[i][k], found[j][k])
+			}
+		}
+		return false
+	})
+	return count, found
+}
+
+// getTrianglesHandler lists the trios of users who are all friends with each
+// other. Count covers every triangle; at most config.MaxTriangles are listed,
+// and truncated tells whether some were left out.
+func getTrianglesHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	count, found := triangles(config.MaxTriangles)
+	usersMutex.RUnlock()
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Count     int         `json:"count"`
+		Triangles [][3]string `json:"triangles"`
+		Truncated bool        `json:"truncated"`
+	}{count, found, count > len(found)})
+}
+
+// getAdjacencyMatrixHandler exports the friendship graph as a 0/1 matrix
+// whose rows and columns follow the sorted user IDs. The response grows with
+// the square of the user count, so graphs above config.MaxMatrixUsers are
+// refused with 413.
+func getAdjacencyMatrixHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	if len(users) > config.MaxMatrixUsers {
+		httpError(w, r, http.StatusRequestEntityTooLarge, "matrix_too_large", config.MaxMatrixUsers)
+		return
+	}
+
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	index := make(map[string]int, len(ids))
+	for i, id := range ids {
+		index[id] = i
+	}
+	matrix := make([][]int, len(ids))
+	for i, id := range ids {
+		matrix[i] = make([]int, len(ids))
+		for _, friendID := range users[id].friendIDs() {
+			if j, ok := index[friendID]; ok {
+				matrix[i][j] = 1
+			}
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		IDs    []string `json:"ids"`
+		Matrix [][]int  `json:"matrix"`
+	}{ids, matrix})
+}
@@ -0,0 +1,792 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedUsers stores users directly, bypassing the handlers, so tests can set
+// up state the API would not produce.
+func seedUsers(t *testing.T, seeded map[string]User) {
+	t.Helper()
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	for id, user := range seeded {
+		putUser(id, user)
+	}
+}
+
+func friendsOf(ids ...string) []Friend {
+	friends := make([]Friend, len(ids))
+	for i, id := range ids {
+		friends[i] = Friend{ID: id}
+	}
+	return friends
+}
+
+func userIDs(users []userResponse) []string {
+	ids := []string{}
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+type edgeList struct {
+	Count int    `json:"count"`
+	Edges []edge `json:"edges"`
+}
+
+func TestGraphEdgesAreUnique(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	a, b, c := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20)
+	makeFriends(t, h, a, b, b, a, b, c, c, a, a, c)
+
+	rec := do(t, h, http.MethodGet, "/graph/edges", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[edgeList](t, rec)
+
+	want := []edge{{a, b}, {a, c}, {b, c}}
+	if got.Count != len(want) || len(got.Edges) != len(want) {
+		t.Fatalf("got %+v, want edges %v", got, want)
+	}
+	for i, e := range want {
+		if got.Edges[i] != e {
+			t.Errorf("edge %d = %v, want %v", i, got.Edges[i], e)
+		}
+	}
+}
+
+func TestGraphEdgesSkipDamagedEntries(t *testing.T) {
+	resetState(t)
+	seedUsers(t, map[string]User{
+		"1": {Name: "a", Friends: friendsOf("1", "2", "2", "99")},
+		"2": {Name: "b", Friends: friendsOf("1")},
+	})
+
+	rec := do(t, newRouter(), http.MethodGet, "/graph/edges", "")
+	got := decodeResponse[edgeList](t, rec)
+	if got.Count != 1 || len(got.Edges) != 1 || got.Edges[0] != (edge{"1", "2"}) {
+		t.Errorf("got %+v, want the single edge 1-2", got)
+	}
+}
+
+func TestEdgeCountMatchesEdgeList(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	edgeCount := func() int {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/graph/edge_count", "")
+		expectStatus(t, rec, http.StatusOK)
+		count := decodeResponse[struct{ Edges int }](t, rec).Edges
+		if listed := decodeResponse[edgeList](t, do(t, h, http.MethodGet, "/graph/edges", "")).Count; count != listed {
+			t.Errorf("edge_count = %d, /graph/edges has %d", count, listed)
+		}
+		return count
+	}
+
+	if n := edgeCount(); n != 0 {
+		t.Errorf("empty graph has %d edges", n)
+	}
+
+	newGraph(t, h, 3, "1", "2", "2", "3", "2", "1", "1", "2")
+	expectStatus(t, do(t, h, http.MethodPost, "/make_friends", `{"source_id":"1","target_id":"1"}`), http.StatusBadRequest)
+	if n := edgeCount(); n != 2 {
+		t.Errorf("edges = %d, want 2", n)
+	}
+
+	// A repeated or missing friend rejects the whole creation.
+	expectStatus(t, do(t, h, http.MethodPost, "/create", `{"name":"d","age":20,"friends":["1","1","99","99"]}`), http.StatusBadRequest)
+	if n := edgeCount(); n != 2 {
+		t.Errorf("edges = %d, want 2", n)
+	}
+	expectStatus(t, do(t, h, http.MethodPost, "/create", `{"name":"d","age":20,"friends":["1","3"]}`), http.StatusCreated)
+	if n := edgeCount(); n != 4 {
+		t.Errorf("edges = %d, want 4", n)
+	}
+}
+
+// newGraph creates users 1 to n, all aged 20, and befriends each
+// consecutive pair of ids.
+func newGraph(t *testing.T, h http.Handler, n int, ids ...string) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		createUser(t, h, "u"+strconv.Itoa(i), 20)
+	}
+	makeFriends(t, h, ids...)
+}
+
+func TestStrongPairs(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// 1 and 2 share 3, 4 and 5; 6 only knows 3.
+	newGraph(t, h, 6, "1", "3", "1", "4", "1", "5", "2", "3", "2", "4", "2", "5", "6", "3")
+
+	type pairs struct {
+		Count int          `json:"count"`
+		Pairs []strongPair `json:"pairs"`
+	}
+	tests := []struct {
+		query string
+		want  []strongPair
+	}{
+		{"min_mutual=3", []strongPair{{"1", "2", 3}}},
+		{"min_mutual=2", []strongPair{{"1", "2", 3}, {"3", "4", 2}, {"3", "5", 2}, {"4", "5", 2}}},
+		{"min_mutual=2&limit=2&offset=1", []strongPair{{"3", "4", 2}, {"3", "5", 2}}},
+		{"min_mutual=4", []strongPair{}},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, "/graph/strong_pairs?"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		got := decodeResponse[pairs](t, rec)
+		if !slices.Equal(got.Pairs, tt.want) {
+			t.Errorf("%s: pairs = %v, want %v", tt.query, got.Pairs, tt.want)
+		}
+	}
+
+	got := decodeResponse[pairs](t, do(t, h, http.MethodGet, "/graph/strong_pairs", ""))
+	if got.Count != 6 {
+		t.Errorf("min_mutual=1 count = %d, want 6", got.Count)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/graph/strong_pairs?min_mutual=0", ""), http.StatusBadRequest)
+}
+
+func TestStrongPairsEmptyGraph(t *testing.T) {
+	resetState(t)
+	rec := do(t, newRouter(), http.MethodGet, "/graph/strong_pairs", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Body.String(); got != `{"count":0,"pairs":[]}`+"\n" {
+		t.Errorf("body = %s", got)
+	}
+}
+
+func TestGraphConcurrencyLimitSparesCRUD(t *testing.T) {
+	resetState(t)
+	config.MaxConcurrentGraphRequests = 1
+	h := newRouter()
+	createUser(t, h, "a", 20)
+
+	// With the store locked, a traversal that got its slot waits for the
+	// lock while holding it.
+	usersMutex.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			usersMutex.Unlock()
+		}
+	}()
+
+	graph := make(chan int, 1)
+	go func() { graph <- do(t, h, http.MethodGet, "/graph/strong_pairs", "").Code }()
+	for deadline := time.Now().Add(5 * time.Second); inFlight.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("traversal never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Give it time to pass the limiter and block on the lock.
+	time.Sleep(50 * time.Millisecond)
+
+	expectStatus(t, do(t, h, http.MethodGet, "/graph/central", ""), http.StatusServiceUnavailable)
+
+	crud := make(chan int, 1)
+	go func() { crud <- do(t, h, http.MethodGet, "/users", "").Code }()
+	time.Sleep(50 * time.Millisecond)
+	usersMutex.Unlock()
+	locked = false
+
+	if code := <-crud; code != http.StatusOK {
+		t.Errorf("/users during a saturated graph budget = %d, want 200", code)
+	}
+	if code := <-graph; code != http.StatusOK {
+		t.Errorf("traversal holding the slot = %d, want 200", code)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/graph/central", ""), http.StatusOK)
+}
+
+// twoTrianglesAndBridge builds triangles 1-2-3 and 5-6-7 joined through
+// user 4, plus the isolated user 8.
+func twoTrianglesAndBridge(t *testing.T, h http.Handler) {
+	t.Helper()
+	newGraph(t, h, 8, "1", "2", "2", "3", "1", "3", "5", "6", "6", "7", "5", "7", "3", "4", "4", "5")
+}
+
+func TestCentralUsersFindsBridge(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	twoTrianglesAndBridge(t, h)
+
+	type central struct {
+		SampledSources int           `json:"sampled_sources"`
+		Users          []centralUser `json:"users"`
+	}
+	rec := do(t, h, http.MethodGet, "/graph/central?limit=3", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[central](t, rec)
+
+	want := []centralUser{{"4", "u4", 18}, {"3", "u3", 16}, {"5", "u5", 16}}
+	if got.SampledSources != 8 || !slices.Equal(got.Users, want) {
+		t.Errorf("got %+v, want exact scores %v", got, want)
+	}
+
+	// Sampling is reproducible for a fixed seed.
+	config.CentralitySampleSize = 4
+	h = newRouter()
+	first := do(t, h, http.MethodGet, "/graph/central?seed=7", "").Body.String()
+	if again := do(t, h, http.MethodGet, "/graph/central?seed=7", "").Body.String(); again != first {
+		t.Errorf("seed 7 gave %s, then %s", first, again)
+	}
+	if got := decodeResponse[central](t, do(t, h, http.MethodGet, "/graph/central?seed=7", "")); got.SampledSources != 4 {
+		t.Errorf("sampled %d sources, want 4", got.SampledSources)
+	}
+}
+
+type subgraph struct {
+	Depth     int            `json:"depth"`
+	Nodes     []userResponse `json:"nodes"`
+	Edges     []edge         `json:"edges"`
+	Truncated bool           `json:"truncated"`
+}
+
+func TestSubgraph(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	twoTrianglesAndBridge(t, h)
+
+	tests := []struct {
+		query        string
+		depth        int
+		nodes, edges int
+	}{
+		{"depth=0", 0, 1, 0},
+		{"depth=1", 1, 3, 3},
+		{"", 2, 4, 4},
+		{"depth=3", 3, 5, 5},
+		{"depth=100", config.MaxSubgraphDepth, 7, 8},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, "/user/1/subgraph?"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		got := decodeResponse[subgraph](t, rec)
+		if got.Depth != tt.depth || len(got.Nodes) != tt.nodes || len(got.Edges) != tt.edges || got.Truncated {
+			t.Errorf("%q: depth %d, %d nodes, %d edges; want %d, %d, %d",
+				tt.query, got.Depth, len(got.Nodes), len(got.Edges), tt.depth, tt.nodes, tt.edges)
+		}
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/404/subgraph", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/1/subgraph?depth=-1", ""), http.StatusBadRequest)
+}
+
+func TestExactDistanceOnChain(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// The chain 1-2-3-4-5, and 6 on its own.
+	newGraph(t, h, 6, "1", "2", "2", "3", "3", "4", "4", "5")
+
+	type frontier struct {
+		Distance int            `json:"distance"`
+		Users    []userResponse `json:"users"`
+	}
+	tests := []struct {
+		user, n string
+		want    []string
+	}{
+		{"1", "0", []string{"1"}},
+		{"1", "2", []string{"3"}},
+		{"1", "4", []string{"5"}},
+		{"1", "5", []string{}},
+		{"3", "1", []string{"2", "4"}},
+		{"3", "2", []string{"1", "5"}},
+		{"6", "0", []string{"6"}},
+		{"6", "1", []string{}},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, "/user/"+tt.user+"/exactly/"+tt.n, "")
+		expectStatus(t, rec, http.StatusOK)
+		got := decodeResponse[frontier](t, rec)
+		ids := make([]string, len(got.Users))
+		for i, user := range got.Users {
+			ids[i] = user.ID
+		}
+		if !slices.Equal(ids, tt.want) || strconv.Itoa(got.Distance) != tt.n {
+			t.Errorf("%s at %s: got %v at %d, want %v", tt.user, tt.n, ids, got.Distance, tt.want)
+		}
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/exactly/1", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/1/exactly/-1", ""), http.StatusBadRequest)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/1/exactly/x", ""), http.StatusBadRequest)
+}
+
+func TestGraphMetrics(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// The chain 1-2-3-4, the triangle 5-6-7, and 8 on its own.
+	newGraph(t, h, 8, "1", "2", "2", "3", "3", "4", "5", "6", "6", "7", "7", "5")
+
+	type metrics struct {
+		Exact      bool               `json:"exact"`
+		Components []componentMetrics `json:"components"`
+	}
+	rec := do(t, h, http.MethodGet, "/graph/metrics", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[metrics](t, rec)
+	want := []componentMetrics{
+		{Root: "1", Size: 4, Diameter: 3, AveragePathLength: 10.0 / 6, ClusteringCoefficient: 0, Exact: true},
+		{Root: "5", Size: 3, Diameter: 1, AveragePathLength: 1, ClusteringCoefficient: 1, Exact: true},
+		{Root: "8", Size: 1, Exact: true},
+	}
+	if !got.Exact || !slices.Equal(got.Components, want) {
+		t.Errorf("metrics = %+v, want exact %+v", got, want)
+	}
+
+	// Sampled components are marked, and their diameter is a lower bound.
+	config.GraphMetricsSampleSize = 2
+	got = decodeResponse[metrics](t, do(t, h, http.MethodGet, "/graph/metrics?seed=3", ""))
+	chain := got.Components[0]
+	if got.Exact || chain.Exact || chain.Diameter < 2 || chain.Diameter > 3 {
+		t.Errorf("sampled metrics = %+v", got)
+	}
+	if !got.Components[2].Exact {
+		t.Errorf("single-user component is marked estimated: %+v", got.Components[2])
+	}
+}
+
+func TestUserClustering(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// The triangle 1-2-3; 4 is the hub of the star 4-5, 4-6, 4-7; 7 and 8
+	// also know each other; 9 has one friend.
+	newGraph(t, h, 10, "1", "2", "2", "3", "3", "1", "4", "5", "4", "6", "4", "7", "7", "8", "9", "10")
+
+	clustering := func(id string) float64 {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/user/"+id+"/clustering", "")
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[struct{ Clustering float64 }](t, rec).Clustering
+	}
+
+	tests := map[string]float64{"1": 1, "4": 0, "7": 0, "9": 0}
+	for id, want := range tests {
+		if got := clustering(id); got != want {
+			t.Errorf("clustering of %s = %v, want %v", id, got, want)
+		}
+	}
+
+	// One of the three pairs of the hub's friends linked.
+	makeFriends(t, h, "5", "6")
+	if got := clustering("4"); got != 1.0/3 {
+		t.Errorf("clustering of 4 = %v, want 1/3", got)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/clustering", ""), http.StatusNotFound)
+}
+
+func TestRelationship(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	twoTrianglesAndBridge(t, h)
+
+	type relationship struct {
+		A             userResponse `json:"a"`
+		B             userResponse `json:"b"`
+		Friends       bool         `json:"friends"`
+		MutualFriends int          `json:"mutual_friends"`
+		Distance      *int         `json:"distance"`
+	}
+	tests := []struct {
+		name, a, b string
+		friends    bool
+		mutual     int
+		distance   int // -1 for none
+	}{
+		{"friends", "1", "3", true, 1, 1},
+		{"same component", "1", "7", false, 0, 4},
+		{"shared friend", "3", "5", false, 1, 2},
+		{"disconnected", "1", "8", false, 0, -1},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, "/relationship/"+tt.a+"/"+tt.b, "")
+		expectStatus(t, rec, http.StatusOK)
+		got := decodeResponse[relationship](t, rec)
+		if got.A.ID != tt.a || got.B.ID != tt.b || got.Friends != tt.friends || got.MutualFriends != tt.mutual {
+			t.Errorf("%s: got %+v", tt.name, got)
+		}
+		switch {
+		case tt.distance < 0 && got.Distance != nil:
+			t.Errorf("%s: distance = %d, want null", tt.name, *got.Distance)
+		case tt.distance >= 0 && (got.Distance == nil || *got.Distance != tt.distance):
+			t.Errorf("%s: distance = %v, want %d", tt.name, got.Distance, tt.distance)
+		}
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/relationship/1/99", ""), http.StatusNotFound)
+}
+
+func TestAdjacencyMatrix(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	newGraph(t, h, 3, "1", "2", "3", "2")
+
+	type adjacency struct {
+		IDs    []string `json:"ids"`
+		Matrix [][]int  `json:"matrix"`
+	}
+	rec := do(t, h, http.MethodGet, "/graph/matrix", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[adjacency](t, rec)
+
+	want := [][]int{{0, 1, 0}, {1, 0, 1}, {0, 1, 0}}
+	if !slices.Equal(got.IDs, []string{"1", "2", "3"}) || len(got.Matrix) != len(want) {
+		t.Fatalf("got %+v, want matrix %v", got, want)
+	}
+	for i := range want {
+		if !slices.Equal(got.Matrix[i], want[i]) {
+			t.Errorf("row %d = %v, want %v", i, got.Matrix[i], want[i])
+		}
+		for j := range want {
+			if got.Matrix[i][j] != got.Matrix[j][i] {
+				t.Errorf("matrix is not symmetric at %d,%d", i, j)
+			}
+		}
+	}
+
+	config.MaxMatrixUsers = 2
+	expectStatus(t, do(t, h, http.MethodGet, "/graph/matrix", ""), http.StatusRequestEntityTooLarge)
+}
+
+func TestJaccardSimilarity(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// 1 knows 3, 4 and 5; 2 knows 4, 5, 6 and 7; 8 and 9 know nobody.
+	newGraph(t, h, 9, "1", "3", "1", "4", "1", "5", "2", "4", "2", "5", "2", "6", "2", "7")
+
+	type similarity struct {
+		Similarity   float64 `json:"similarity"`
+		Intersection int     `json:"intersection"`
+		Union        int     `json:"union"`
+	}
+	tests := []struct {
+		a, b string
+		want similarity
+	}{
+		{"1", "2", similarity{0.4, 2, 5}},
+		{"2", "1", similarity{0.4, 2, 5}},
+		{"1", "1", similarity{1, 3, 3}},
+		{"1", "8", similarity{0, 0, 3}},
+		{"8", "9", similarity{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, "/similarity/"+tt.a+"/"+tt.b, "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := decodeResponse[similarity](t, rec); got != tt.want {
+			t.Errorf("%s and %s: got %+v, want %+v", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/similarity/1/99", ""), http.StatusNotFound)
+}
+
+type triangleList struct {
+	Count     int         `json:"count"`
+	Triangles [][3]string `json:"triangles"`
+	Truncated bool        `json:"truncated"`
+}
+
+func TestOneTriangle(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// The triangle 2-4-3 with tails, and the open path 5-6-7.
+	newGraph(t, h, 8, "4", "2", "3", "4", "2", "3", "1", "2", "3", "5", "5", "6", "6", "7", "7", "8")
+
+	rec := do(t, h, http.MethodGet, "/graph/triangles", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[triangleList](t, rec)
+	if got.Count != 1 || len(got.Triangles) != 1 || got.Triangles[0] != [3]string{"2", "3", "4"} || got.Truncated {
+		t.Errorf("triangles = %+v, want only 2-3-4", got)
+	}
+}
+
+func TestTrianglesAreCapped(t *testing.T) {
+	resetState(t)
+	config.MaxTriangles = 2
+	h := newRouter()
+	// The complete graph on 4 users has 4 triangles.
+	newGraph(t, h, 4, "1", "2", "1", "3", "1", "4", "2", "3", "2", "4", "3", "4")
+
+	// The listed ones must not depend on map order.
+	want := [][3]string{{"1", "2", "3"}, {"1", "2", "4"}}
+	for range 20 {
+		got := decodeResponse[triangleList](t, do(t, h, http.MethodGet, "/graph/triangles", ""))
+		if got.Count != 4 || !slices.Equal(got.Triangles, want) || !got.Truncated {
+			t.Fatalf("triangles = %+v, want %v of 4 listed", got, want)
+		}
+	}
+}
+
+func TestPageRank(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// 1, 2 and 3 form a triangle, 4 only knows 1 and 5 has no friends.
+	newGraph(t, h, 5, "1", "2", "1", "3", "2", "3", "1", "4")
+
+	type ranking struct {
+		Iterations int          `json:"iterations"`
+		Converged  bool         `json:"converged"`
+		Users      []rankedUser `json:"users"`
+	}
+	rec := do(t, h, http.MethodGet, "/graph/pagerank", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[ranking](t, rec)
+
+	if !got.Converged || got.Iterations < 1 || got.Iterations > defaultPageRankIterations {
+		t.Errorf("iterations = %d, converged = %v", got.Iterations, got.Converged)
+	}
+	var ids []string
+	sum := 0.0
+	for _, u := range got.Users {
+		ids = append(ids, u.ID)
+		sum += u.Score
+	}
+	if want := []string{"1", "2", "3", "4", "5"}; !slices.Equal(ids, want) {
+		t.Errorf("ranking = %v, want %v", ids, want)
+	}
+	if math.Abs(sum-1) > 1e-6 {
+		t.Errorf("scores sum to %v, want 1", sum)
+	}
+	if s := got.Users; math.Abs(s[1].Score-s[2].Score) > 1e-9 || s[3].Score <= s[4].Score {
+		t.Errorf("scores = %v", s)
+	}
+
+	rec = do(t, h, http.MethodGet, "/graph/pagerank?iterations=1", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[ranking](t, rec); got.Iterations != 1 || got.Converged {
+		t.Errorf("one round: iterations = %d, converged = %v", got.Iterations, got.Converged)
+	}
+
+	for _, query := range []string{"iterations=0", "iterations=1001", "damping=1.5", "damping=x"} {
+		expectStatus(t, do(t, h, http.MethodGet, "/graph/pagerank?"+query, ""), http.StatusBadRequest)
+	}
+}
+
+type clique struct {
+	UserID         string         `json:"user_id"`
+	Users          []userResponse `json:"users"`
+	UsersTruncated bool           `json:"users_truncated"`
+	Edges          []edge         `json:"edges"`
+}
+
+func TestUserClique(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// 1 knows 2 to 5; 2-3 and 3-4 are friends, 5 knows nobody else and
+	// 6 is a friend of 2 only.
+	newGraph(t, h, 6, "1", "2", "1", "3", "1", "4", "1", "5", "2", "3", "3", "4", "2", "6")
+
+	rec := do(t, h, http.MethodGet, "/user/1/clique", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[clique](t, rec)
+
+	ids := userIDs(got.Users)
+	if want := []string{"2", "3", "4"}; !slices.Equal(ids, want) || got.UsersTruncated {
+		t.Errorf("users = %v (truncated %v), want %v", ids, got.UsersTruncated, want)
+	}
+	if want := []edge{{"2", "3"}, {"3", "4"}}; !slices.Equal(got.Edges, want) {
+		t.Errorf("edges = %v, want %v", got.Edges, want)
+	}
+
+	rec = do(t, h, http.MethodGet, "/user/5/clique", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[clique](t, rec); len(got.Users) != 0 || len(got.Edges) != 0 {
+		t.Errorf("leaf clique = %+v, want empty", got)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/404/clique", ""), http.StatusNotFound)
+}
+
+func TestEmbeddedFriendsAreCapped(t *testing.T) {
+	resetState(t)
+	config.MaxEmbeddedFriends = 3
+	h := newRouter()
+	// 1 knows 2 to 6, which form the chain 2-3-4-5-6.
+	newGraph(t, h, 6, "1", "2", "1", "3", "1", "4", "1", "5", "1", "6",
+		"2", "3", "3", "4", "4", "5", "5", "6")
+
+	rec := do(t, h, http.MethodGet, "/user/1/full", "")
+	expectStatus(t, rec, http.StatusOK)
+	full := decodeResponse[fullUser](t, rec)
+	if ids := userIDs(full.Friends); !slices.Equal(ids, []string{"2", "3", "4"}) || !full.FriendsTruncated {
+		t.Errorf("full view friends = %v (truncated %v), want [2 3 4] truncated", ids, full.FriendsTruncated)
+	}
+
+	rec = do(t, h, http.MethodGet, "/user/1/subgraph?depth=1", "")
+	expectStatus(t, rec, http.StatusOK)
+	sub := decodeResponse[subgraph](t, rec)
+	nodes := userIDs(sub.Nodes)
+	if len(nodes) != 3 || !slices.Contains(nodes, "1") || !sub.Truncated {
+		t.Errorf("subgraph nodes = %v (truncated %v), want 3 including 1, truncated", nodes, sub.Truncated)
+	}
+	for _, e := range sub.Edges {
+		if !slices.Contains(nodes, e.Source) || !slices.Contains(nodes, e.Target) {
+			t.Errorf("subgraph edge %v leaves the returned nodes %v", e, nodes)
+		}
+	}
+	if len(sub.Edges) < 2 {
+		t.Errorf("subgraph edges = %v, want the hub's edges to the returned nodes", sub.Edges)
+	}
+
+	rec = do(t, h, http.MethodGet, "/user/1/clique", "")
+	expectStatus(t, rec, http.StatusOK)
+	c := decodeResponse[clique](t, rec)
+	if ids := userIDs(c.Users); !slices.Equal(ids, []string{"2", "3", "4"}) || !c.UsersTruncated {
+		t.Errorf("clique users = %v (truncated %v), want [2 3 4] truncated", ids, c.UsersTruncated)
+	}
+	if want := []edge{{"2", "3"}, {"3", "4"}}; !slices.Equal(c.Edges, want) {
+		t.Errorf("clique edges = %v, want %v", c.Edges, want)
+	}
+
+	config.MaxEmbeddedFriends = 10
+	rec = do(t, h, http.MethodGet, "/user/1/subgraph?depth=1", "")
+	if sub := decodeResponse[subgraph](t, rec); len(sub.Nodes) != 6 || len(sub.Edges) != 9 || sub.Truncated {
+		t.Errorf("uncapped subgraph: %d nodes, %d edges, truncated %v", len(sub.Nodes), len(sub.Edges), sub.Truncated)
+	}
+}
+
+type degreeDistribution struct {
+	Users         int         `json:"users"`
+	AverageDegree float64     `json:"average_degree"`
+	MaxDegree     int         `json:"max_degree"`
+	Distribution  map[int]int `json:"distribution"`
+}
+
+func TestDegreeDistribution(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	rec := do(t, h, http.MethodGet, "/graph/degree_distribution", "")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), `"distribution":{}`) {
+		t.Errorf("empty graph body = %s, want an empty distribution", rec.Body)
+	}
+	if got := decodeResponse[degreeDistribution](t, rec); got.Users != 0 || got.AverageDegree != 0 || got.MaxDegree != 0 {
+		t.Errorf("empty graph = %+v", got)
+	}
+
+	// Degrees: 1 has 3, 2 and 3 have 2, 4 has 1 and 5 none.
+	newGraph(t, h, 5, "1", "2", "1", "3", "1", "4", "2", "3")
+	rec = do(t, h, http.MethodGet, "/graph/degree_distribution", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[degreeDistribution](t, rec)
+	want := degreeDistribution{5, 1.6, 3, map[int]int{0: 1, 1: 1, 2: 2, 3: 1}}
+	if got.Users != want.Users || got.AverageDegree != want.AverageDegree || got.MaxDegree != want.MaxDegree ||
+		!maps.Equal(got.Distribution, want.Distribution) {
+		t.Errorf("distribution = %+v, want %+v", got, want)
+	}
+
+	// A repeated, a dangling and a self entry add no degree, so the
+	// degrees still sum to twice the edge count.
+	resetState(t)
+	seedUsers(t, map[string]User{
+		"1": {Name: "a", Friends: friendsOf("2", "2", "99", "1")},
+		"2": {Name: "b", Friends: friendsOf("1")},
+		"3": {Name: "c"},
+	})
+	rec = do(t, h, http.MethodGet, "/graph/degree_distribution", "")
+	expectStatus(t, rec, http.StatusOK)
+	got = decodeResponse[degreeDistribution](t, rec)
+	edges := decodeResponse[struct{ Edges int }](t, do(t, h, http.MethodGet, "/graph/edge_count", "")).Edges
+	if got.MaxDegree != 1 || !maps.Equal(got.Distribution, map[int]int{0: 1, 1: 2}) ||
+		got.AverageDegree*float64(got.Users) != float64(2*edges) {
+		t.Errorf("dirty graph distribution = %+v with %d edges", got, edges)
+	}
+}
+
+func TestLoadConfigRejectsGraphLimits(t *testing.T) {
+	for _, body := range []string{
+		`{"centrality_sample_size":0}`,
+		`{"graph_metrics_sample_size":-1}`,
+		`{"max_subgraph_depth":-1}`,
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("config %s loaded", body)
+		}
+	}
+}
+
+func TestUserReach(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// Triangle 1-2-3 joined at 3 to the cycle 3-4-5; 6 is isolated.
+	newGraph(t, h, 6, "1", "2", "2", "3", "3", "1", "3", "4", "4", "5", "5", "3")
+
+	type reach struct {
+		UserID string `json:"user_id"`
+		Reach  int    `json:"reach"`
+	}
+	for id, want := range map[string]int{"1": 4, "4": 4, "6": 0} {
+		rec := do(t, h, http.MethodGet, "/user/"+id+"/reach", "")
+		expectStatus(t, rec, http.StatusOK)
+		if got := decodeResponse[reach](t, rec); got.UserID != id || got.Reach != want {
+			t.Errorf("reach of %s = %+v, want %d", id, got, want)
+		}
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/reach", ""), http.StatusNotFound)
+}
+
+func TestLongestChain(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// The path 1-2-3-4, the cycle 5-6-7-8-5, and 9 on its own.
+	newGraph(t, h, 9, "1", "2", "2", "3", "3", "4", "5", "6", "6", "7", "7", "8", "8", "5")
+
+	type chain struct {
+		Length  int      `json:"length"`
+		Chain   []string `json:"chain"`
+		Bounded bool     `json:"bounded"`
+	}
+	longest := func(id string) chain {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/user/"+id+"/longest_chain", "")
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[chain](t, rec)
+	}
+
+	tests := []struct {
+		id   string
+		want []string
+	}{
+		{"9", []string{"9"}},
+		{"1", []string{"1", "2", "3", "4"}},
+		{"2", []string{"2", "3", "4"}},
+		// The cycle is walked once round, never back to the start.
+		{"5", []string{"5", "6", "7", "8"}},
+	}
+	for _, tt := range tests {
+		got := longest(tt.id)
+		if got.Length != len(tt.want)-1 || !slices.Equal(got.Chain, tt.want) || got.Bounded {
+			t.Errorf("longest chain from %s = %+v, want %v", tt.id, got, tt.want)
+		}
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/longest_chain", ""), http.StatusNotFound)
+
+	config.LongestChainMaxDepth = 2
+	if got := longest("1"); got.Length != 2 || !slices.Equal(got.Chain, []string{"1", "2", "3"}) || !got.Bounded {
+		t.Errorf("with a depth limit of 2, longest chain from 1 = %+v, want 1-2-3 bounded", got)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+var messages = map[string]map[string]string{
+	"en": {
+		"invalid_body":           "Invalid request body",
+		"users_empty":            "User list is empty",
+		"encode_failed":          "Failed to build response",
+		"users_not_found":        "One or both users not found",
+		"user_not_found":         "User not found",
+		"user_created":           "User ID: %s",
+		"now_friends":            "%s and %s are now friends",
+		"already_friends":        "%s and %s are already friends",
+		"index_out_of_range":     "No user at index %d",
+		"age_updated":            "User age updated successfully",
+		"unsupported_media_type": "Content-Type must be application/json",
+		"admin_disabled":         "Admin endpoints are disabled",
+		"unauthorized":           "Unauthorized",
+		"invalid_snapshot":       "Invalid snapshot: %v",
+		"state_restored":         "State restored: %d users",
+		"nothing_to_undo":        "Nothing to undo",
+		"undone":                 "Undone: %s",
+		"invalid_friend_ids":     "Invalid friend IDs: %s",
+		"friends_replaced":       "Friend list replaced: %d friends",
+		"invalid_param":          "Invalid value for parameter %s",
+		"invalid_time_range":     "%s must not be later than %s",
+		"invalid_range":          "%s must not be greater than %s",
+		"query_shape":            "Each query node needs exactly one of a non-empty and, a non-empty or, or a field",
+		"query_field":            "Unsupported query field %q",
+		"query_op":               "Operator %q is not supported for field %s",
+		"query_value":            "Invalid value for field %s",
+		"query_too_large":        "Query must be at most %d levels deep and %d nodes in total",
+		"server_busy":            "Server is busy, try again later",
+		"store_unavailable":      "User store is unavailable, try again later",
+		"merge_into_self":        "Cannot merge a user into itself",
+		"age_or_delta":           "Exactly one of new_age or delta is required",
+		"age_out_of_range":       "Age must be between %d and %d",
+		"duplicate_id":           "Duplicate ID",
+		"batch_rejected":         "Batch rejected, no changes were applied",
+		"not_found":              "Not found",
+		"duplicate_user":         "A user with this name and age already exists",
+		"method_not_allowed":     "Method not allowed",
+		"unknown_field":          "Unknown field: %s",
+		"self_friendship":        "A user cannot befriend themselves",
+		"uri_too_long":           "Request URI must not exceed %d bytes",
+		"name_required":          "Name must not be empty",
+		"negative_weight":        "Weight must not be negative",
+		"not_friends":            "Users are not friends",
+		"conflicting_params":     "Parameters cannot be combined: %s",
+		"request_timeout":        "Request timed out",
+		"maintenance":            "Service is in maintenance mode, writes are disabled",
+		"precondition_failed":    "User was modified after the given time",
+		"schema_version":         "Unsupported X-Schema-Version",
+		"invalid_email":          "Invalid email address",
+		"csv_required":           "Content-Type must be text/csv",
+		"ndjson_required":        "Content-Type must be application/x-ndjson",
+		"self_block":             "A user cannot block themselves",
+		"blocked":                "One of the users has blocked the other",
+		"blocked_friend_ids":     "Blocked friend IDs: %s",
+		"matrix_too_large":       "Graph is too large for a matrix export, limit is %d users",
+	},
+	"ru": {
+		"invalid_body":           "Некорректное тело запроса",
+		"users_empty":            "Список пользователей пуст",
+		"encode_failed":          "Ошибка при формировании ответа",
+		"users_not_found":        "Один или оба пользователя не найдены",
+		"user_not_found":         "Пользователь не найден",
+		"user_created":           "ID пользователя: %s",
+		"now_friends":            "%s и %s теперь друзья",
+		"already_friends":        "%s и %s уже друзья",
+		"index_out_of_range":     "Нет пользователя с индексом %d",
+		"age_updated":            "Возраст пользователя успешно обновлён",
+		"unsupported_media_type": "Content-Type должен быть application/json",
+		"admin_disabled":         "Административные эндпоинты отключены",
+		"unauthorized":           "Требуется авторизация",
+		"invalid_snapshot":       "Некорректный снимок: %v",
+		"state_restored":         "Состояние восстановлено: пользователей %d",
+		"nothing_to_undo":        "Нечего отменять",
+		"undone":                 "Отменено: %s",
+		"invalid_friend_ids":     "Некорректные ID друзей: %s",
+		"friends_replaced":       "Список друзей заменён: друзей %d",
+		"invalid_param":          "Некорректное значение параметра %s",
+		"invalid_time_range":     "%s не может быть позже %s",
+		"invalid_range":          "%s не может быть больше %s",
+		"query_shape":            "Каждый узел запроса должен содержать ровно одно из: непустой and, непустой or или field",
+		"query_field":            "Неподдерживаемое поле запроса %q",
+		"query_op":               "Оператор %q не поддерживается для поля %s",
+		"query_value":            "Некорректное значение для поля %s",
+		"query_too_large":        "Запрос должен быть не глубже %d уровней и содержать не более %d узлов",
+		"server_busy":            "Сервер перегружен, повторите попытку позже",
+		"store_unavailable":      "Хранилище пользователей недоступно, повторите попытку позже",
+		"merge_into_self":        "Нельзя объединить пользователя с самим собой",
+		"age_or_delta":           "Укажите ровно одно из полей new_age или delta",
+		"age_out_of_range":       "Возраст должен быть от %d до %d",
+		"duplicate_id":           "Повторяющийся ID",
+		"batch_rejected":         "Пакет отклонён, изменения не применены",
+		"not_found":              "Не найдено",
+		"duplicate_user":         "Пользователь с таким именем и возрастом уже существует",
+		"method_not_allowed":     "Метод не поддерживается",
+		"unknown_field":          "Неизвестное поле: %s",
+		"self_friendship":        "Пользователь не может дружить сам с собой",
+		"uri_too_long":           "URI запроса не должен превышать %d байт",
+		"name_required":          "Имя не может быть пустым",
+		"negative_weight":        "Вес не может быть отрицательным",
+		"not_friends":            "Пользователи не являются друзьями",
+		"conflicting_params":     "Параметры нельзя использовать вместе: %s",
+		"request_timeout":        "Время обработки запроса истекло",
+		"maintenance":            "Сервис на обслуживании, запись отключена",
+		"precondition_failed":    "Пользователь изменён после указанного времени",
+		"schema_version":         "Неподдерживаемая версия X-Schema-Version",
+		"invalid_email":          "Некорректный адрес электронной почты",
+		"csv_required":           "Content-Type должен быть text/csv",
+		"ndjson_required":        "Content-Type должен быть application/x-ndjson",
+		"self_block":             "Пользователь не может заблокировать сам себя",
+		"blocked":                "Один из пользователей заблокировал другого",
+		"blocked_friend_ids":     "Заблокированные ID друзей: %s",
+		"matrix_too_large":       "Граф слишком велик для выгрузки матрицей, предел %d пользователей",
+	},
+}
+
+func requestLocale(r *http.Request) string {
+	type candidate struct {
+		locale string
+		q      float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := messages[base]; !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{base, q})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return config.DefaultLocale
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].locale
+}
+
+func msg(r *http.Request, id string, args ...any) string {
+	text, ok := messages[requestLocale(r)][id]
+	if !ok {
+		text, ok = messages["en"][id]
+	}
+	if !ok {
+		text = id
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// errorResponse is the body of every error reply. RequestID matches the
+// X-Request-ID response header and the server logs.
+type errorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func newErrorResponse(r *http.Request, id string, args ...any) errorResponse {
+	return errorResponse{
+		Error:     msg(r, id, args...),
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+func httpError(w http.ResponseWriter, r *http.Request, status int, id string, args ...any) {
+	if status == http.StatusBadRequest || status == http.StatusUnsupportedMediaType {
+		countValidationError(r)
+	}
+	if status >= http.StatusInternalServerError {
+		log.Printf("[%s] %s %s: %d %s", middleware.GetReqID(r.Context()), r.Method, r.URL.Path, status, id)
+	}
+	writeJSON(w, r, status, newErrorResponse(r, id, args...))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMessagesCoverEveryLocale(t *testing.T) {
+	for locale, catalog := range messages {
+		for id := range messages["en"] {
+			if _, ok := catalog[id]; !ok {
+				t.Errorf("%s: missing message %q", locale, id)
+			}
+		}
+		for id := range catalog {
+			if _, ok := messages["en"][id]; !ok {
+				t.Errorf("%s: message %q has no English original", locale, id)
+			}
+		}
+	}
+}
+
+func TestErrorsAreLocalized(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "User not found"},
+		{"en", "User not found"},
+		{"ru", "Пользователь не найден"},
+		{"ru-RU,ru;q=0.9", "Пользователь не найден"},
+		{"de, ru;q=0.5, en;q=0.8", "User not found"},
+		{"de", "User not found"},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, "/user/1", "", "Accept-Language", tt.acceptLanguage)
+		expectStatus(t, rec, http.StatusNotFound)
+		if got := decodeResponse[errorResponse](t, rec).Error; got != tt.want {
+			t.Errorf("Accept-Language %q: error = %q, want %q", tt.acceptLanguage, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultLocale(t *testing.T) {
+	resetState(t)
+	config.DefaultLocale = "ru"
+	h := newRouter()
+
+	rec := do(t, h, http.MethodGet, "/user/1", "")
+	if got := decodeResponse[errorResponse](t, rec).Error; got != "Пользователь не найден" {
+		t.Errorf("error = %q, want the ru message", got)
+	}
+	rec = do(t, h, http.MethodGet, "/user/1", "", "Accept-Language", "en")
+	if got := decodeResponse[errorResponse](t, rec).Error; got != "User not found" {
+		t.Errorf("error = %q, want the en message", got)
+	}
+}
+
+func TestErrorsCarryRequestID(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	rec := do(t, h, http.MethodGet, "/user/1", "")
+	expectStatus(t, rec, http.StatusNotFound)
+	header := rec.Header().Get("X-Request-Id")
+	if header == "" {
+		t.Fatal("no X-Request-Id header")
+	}
+	if body := decodeResponse[errorResponse](t, rec).RequestID; body != header {
+		t.Errorf("request_id = %q, header = %q", body, header)
+	}
+
+	// An ID sent by the client is kept, so it can correlate its own logs.
+	rec = do(t, h, http.MethodPost, "/create", `{"name":""}`, "X-Request-Id", "client-42")
+	expectStatus(t, rec, http.StatusBadRequest)
+	if header := rec.Header().Get("X-Request-Id"); header != "client-42" {
+		t.Errorf("X-Request-Id = %q, want client-42", header)
+	}
+	if body := decodeResponse[errorResponse](t, rec).RequestID; body != "client-42" {
+		t.Errorf("request_id = %q, want client-42", body)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportErrors bounds how many failed rows an import lists; later
+// failures are only counted.
+const maxImportErrors = 100
+
+type importError struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+type importSummary struct {
+	Created int           `json:"created"`
+	Failed  int           `json:"failed"`
+	Errors  []importError `json:"errors"`
+	// ErrorsTruncated is set when more than maxImportErrors rows failed.
+	ErrorsTruncated bool `json:"errors_truncated"`
+}
+
+func (s *importSummary) fail(line int, reason string) {
+	s.Failed++
+	if len(s.Errors) < maxImportErrors {
+		s.Errors = append(s.Errors, importError{line, reason})
+	} else {
+		s.ErrorsTruncated = true
+	}
+}
+
+// importRow turns one CSV record (name, age and an optional email) into a
+// user, or returns the catalog message explaining why it cannot.
+func importRow(record []string) (createUserRequest, *queryError) {
+	if len(record) < 2 || len(record) > 3 {
+		return createUserRequest{}, &queryError{id: "invalid_body"}
+	}
+	age, err := strconv.Atoi(strings.TrimSpace(record[1]))
+	if err != nil {
+		return createUserRequest{}, &queryError{id: "invalid_body"}
+	}
+
+	req := createUserRequest{Name: record[0], Age: age}
+	if len(record) == 3 {
+		req.Email = record[2]
+	}
+	if qerr := req.clean(); qerr != nil {
+		return createUserRequest{}, qerr
+	}
+	return req, nil
+}
+
+// clearDeadlines lifts the server's ReadTimeout and WriteTimeout for the
+// rest of the request, which would otherwise cut an import off partway
+// through a body that is as long as the data. name labels the log line of a
+// writer that fails to clear them.
+func clearDeadlines(w http.ResponseWriter, name string) {
+	rc := http.NewResponseController(w)
+	for _, clear := range []func(time.Time) error{rc.SetReadDeadline, rc.SetWriteDeadline} {
+		if err := clear(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("%s: %v", name, err)
+		}
+	}
+}
+
+// importUsersHandler creates users from a CSV body of name,age[,email] rows,
+// with an optional name,age header. Rows are read and stored one at a time,
+// so memory use does not grow with the file; the lock is taken per row and
+// other requests interleave with a long import. Bad rows are skipped and
+// reported by line number. Imported users are not recorded for undo, and
+// the server's read and write timeouts do not apply.
+func importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !(contentType == "" && config.AllowMissingContentType) {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "text/csv" {
+			httpError(w, r, http.StatusUnsupportedMediaType, "csv_required")
+			return
+		}
+	}
+	clearDeadlines(w, "import users")
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	summary := importSummary{Errors: []importError{}}
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			summary.fail(parseErr.Line, msg(r, "invalid_body"))
+			continue
+		}
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "invalid_body")
+			return
+		}
+		if first && len(record) >= 2 && strings.EqualFold(strings.TrimSpace(record[0]), "name") {
+			continue
+		}
+
+		line, _ := reader.FieldPos(0)
+		request, qerr := importRow(record)
+		if qerr != nil {
+			summary.fail(line, msg(r, qerr.id, qerr.args...))
+			continue
+		}
+
+		if _, qerr := importUser(request); qerr != nil {
+			summary.fail(line, msg(r, qerr.id, qerr.args...))
+			continue
+		}
+		summary.Created++
+	}
+
+	writeJSON(w, r, http.StatusOK, summary)
+}
+
+// importUser stores one user of a bulk import under its own lock, so other
+// requests interleave with a long import. Unlike insertUser it records no
+// undo, which would only push everything else out of the undo log. Its
+// friends are checked and linked on both sides as for /create, and nothing
+// is stored when checkNewUser rejects the user.
+func importUser(request createUserRequest) (string, *queryError) {
+	newUser := request.toUser(clock().UTC())
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	if qerr := checkNewUser(newUser, request.Friends); qerr != nil {
+		return "", qerr
+	}
+	return storeUser(newUser, request.Friends), nil
+}
+
+// maxNDJSONLine caps the length of one line of a /users/bulk_stream body.
+const maxNDJSONLine = 64 << 10
+
+type bulkResult struct {
+	Line  int    `json:"line"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// bulkStreamHandler creates users from a newline-delimited JSON body, one
+// user object per line in the schema version of the request, and answers
+// with one ndjson result per non-blank line as it goes: the assigned ID or
+// the reason the line was rejected. Neither side is buffered, so memory
+// stays flat however long the body is. Friends on a line must name existing
+// users, those created by earlier lines included, and are linked on both
+// sides. As with /users/import, bad lines are skipped, nothing is recorded
+// for undo and the server's read and write timeouts do not apply.
+func bulkStreamHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !(contentType == "" && config.AllowMissingContentType) {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/x-ndjson" {
+			httpError(w, r, http.StatusUnsupportedMediaType, "ndjson_required")
+			return
+		}
+	}
+	version := r.Header.Get(schemaVersionHeader)
+	if _, ok := userDecoders[version]; version != "" && !ok {
+		httpError(w, r, http.StatusBadRequest, "schema_version")
+		return
+	}
+	clearDeadlines(w, "bulk stream")
+
+	// HTTP/1.x otherwise stops reading the body once the response starts.
+	// The status goes out with the first result rather than up front, after
+	// the first read, which is also what answers Expect: 100-continue.
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("bulk stream: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 4096), maxNDJSONLine)
+	written := 0
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		result := bulkResult{Line: line}
+		request, qerr := decodeUserRequest(version, bytes.NewReader(text))
+		if qerr == nil {
+			result.ID, qerr = importUser(request)
+		}
+		if qerr != nil {
+			result.Error = msg(r, qerr.id, qerr.args...)
+		}
+
+		if err := encoder.Encode(result); err != nil {
+			log.Printf("bulk stream: %v", err)
+			return
+		}
+		written++
+		if flusher != nil && written%streamFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// The status is already sent; report the failure in-band.
+		encoder.Encode(bulkResult{Error: msg(r, "invalid_body")})
+	}
+}
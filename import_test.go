@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportLargeCSV(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	// Every 1000th row has a bad age; line numbers count the header.
+	const rows = 20000
+	var body strings.Builder
+	body.WriteString("name,age,email\n")
+	for i := 1; i <= rows; i++ {
+		age := fmt.Sprint(20 + i%50)
+		if i%1000 == 0 {
+			age = "old"
+		}
+		fmt.Fprintf(&body, "user%d,%s,user%d@example.com\n", i, age, i)
+	}
+
+	rec := do(t, h, http.MethodPost, "/users/import", body.String(), "Content-Type", "text/csv")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[importSummary](t, rec)
+	if got.Created != rows-20 || got.Failed != 20 || len(got.Errors) != 20 || got.ErrorsTruncated {
+		t.Fatalf("summary: created %d, failed %d, %d errors, truncated %v", got.Created, got.Failed, len(got.Errors), got.ErrorsTruncated)
+	}
+	if got.Errors[0].Line != 1001 || got.Errors[19].Line != 20001 {
+		t.Errorf("error lines %d to %d, want 1001 to 20001", got.Errors[0].Line, got.Errors[19].Line)
+	}
+
+	usersMutex.RLock()
+	count, last := len(users), users[fmt.Sprint(rows-20)]
+	usersMutex.RUnlock()
+	if count != rows-20 || last.Name != "user19999" || last.Email != "user19999@example.com" {
+		t.Errorf("%d users stored, last %+v", count, last)
+	}
+}
+
+func TestImportErrorsAreCapped(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	body := strings.Repeat("x,-1\n", maxImportErrors+5) + "ok,30\n"
+	rec := do(t, h, http.MethodPost, "/users/import", body, "Content-Type", "text/csv")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[importSummary](t, rec)
+	if got.Created != 1 || got.Failed != maxImportErrors+5 || len(got.Errors) != maxImportErrors || !got.ErrorsTruncated {
+		t.Errorf("summary: created %d, failed %d, %d errors, truncated %v", got.Created, got.Failed, len(got.Errors), got.ErrorsTruncated)
+	}
+}
+
+// slowUpload starts a server with short read and write timeouts and posts the
+// lines to target one at a time, taking several timeouts in all.
+func slowUpload(t *testing.T, target, contentType string, lines []string) *http.Response {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(newRouter())
+	srv.Config.ReadTimeout = 50 * time.Millisecond
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	body, pw := io.Pipe()
+	go func() {
+		for _, line := range lines {
+			time.Sleep(200 * time.Millisecond / time.Duration(len(lines)))
+			io.WriteString(pw, line+"\n")
+		}
+		pw.Close()
+	}()
+
+	resp, err := http.Post(srv.URL+target, contentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestImportOutlivesServerTimeouts(t *testing.T) {
+	resetState(t)
+
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("user%d,30", i)
+	}
+	resp := slowUpload(t, "/users/import", "text/csv", lines)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	var got importSummary
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || got.Created != len(lines) {
+		t.Errorf("summary = %+v, %v; want %d created", got, err, len(lines))
+	}
+}
+
+func decodeBulkResults(t *testing.T, body io.Reader) []bulkResult {
+	t.Helper()
+	var results []bulkResult
+	dec := json.NewDecoder(body)
+	for dec.More() {
+		var result bulkResult
+		if err := dec.Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func TestBulkStreamReportsEachLine(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	body := strings.Join([]string{
+		`{"name":"a","age":20}`,
+		`{"name":"b",`,
+		``,
+		`{"name":"c","age":"old"}`,
+		`{"name":"d","age":40}`,
+	}, "\n")
+	rec := do(t, h, http.MethodPost, "/users/bulk_stream", body, "Content-Type", "application/x-ndjson")
+	expectStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	got := decodeBulkResults(t, rec.Body)
+	if len(got) != 4 {
+		t.Fatalf("results = %+v, want 4", got)
+	}
+	for i, want := range []struct {
+		line int
+		ok   bool
+	}{{1, true}, {2, false}, {4, false}, {5, true}} {
+		if r := got[i]; r.Line != want.line || (r.ID != "") != want.ok || (r.Error == "") != want.ok {
+			t.Errorf("result %d = %+v, want line %d ok %v", i, r, want.line, want.ok)
+		}
+	}
+	if got[0].ID == got[3].ID {
+		t.Errorf("both users got ID %s", got[0].ID)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+got[3].ID, ""), http.StatusOK)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/users/bulk_stream", body), http.StatusUnsupportedMediaType)
+}
+
+func TestBulkStreamOutlivesServerTimeouts(t *testing.T) {
+	resetState(t)
+
+	lines := make([]string, 10)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`{"name":"user%d","age":30}`, i)
+	}
+	resp := slowUpload(t, "/users/bulk_stream", "application/x-ndjson", lines)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	got := decodeBulkResults(t, resp.Body)
+	if len(got) != len(lines) {
+		t.Fatalf("got %d results, want %d: %+v", len(got), len(lines), got)
+	}
+	for _, r := range got {
+		if r.Error != "" {
+			t.Errorf("line %d: %s", r.Line, r.Error)
+		}
+	}
+}
+
+func TestBulkStreamValidatesFriendsAndAge(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	body := strings.Join([]string{
+		`{"name":"a","age":20}`,
+		`{"name":"b","age":20,"friends":["1","12345"]}`,
+		`{"name":"c","age":20,"friends":["1","1"]}`,
+		`{"name":"d","age":-1}`,
+		`{"name":"e","age":20,"friends":["1"]}`,
+	}, "\n")
+	rec := do(t, h, http.MethodPost, "/users/bulk_stream", body, "Content-Type", "application/x-ndjson")
+	expectStatus(t, rec, http.StatusOK)
+
+	want := []bulkResult{
+		{Line: 1, ID: "1"},
+		{Line: 2, Error: "Invalid friend IDs: 12345"},
+		{Line: 3, Error: "Invalid friend IDs: 1"},
+		{Line: 4, Error: "Age must be between 0 and 150"},
+		{Line: 5, ID: "2"},
+	}
+	if got := decodeBulkResults(t, rec.Body); !slices.Equal(got, want) {
+		t.Errorf("results = %+v, want %+v", got, want)
+	}
+	for id, want := range map[string]string{"1": "2", "2": "1"} {
+		got := friendWeights(t, h, id)
+		if _, ok := got[want]; len(got) != 1 || !ok {
+			t.Errorf("friends of %s = %v, want only %s", id, got, want)
+		}
+	}
+}
@@ -1,25 +1,103 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 type User struct {
 	Name    string   `json:"name"`
 	Age     int      `json:"age"`
-	Friends []string `json:"friends"`
+	Friends []Friend `json:"friends"`
+
+	// Blocked lists the users this user has blocked; see blocks.
+	Blocked []string `json:"blocked,omitempty"`
+
+	// Email is optional and only accepted from v2 request bodies; see
+	// decodeUserRequest. It is stored trimmed and lowercased.
+	Email string `json:"email,omitempty"`
+
+	// UpdatedAt is when the record last changed, friend list included. It
+	// is zero for users loaded from state written before it was tracked;
+	// see lastModified.
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// ExternalID is the user's key in an upstream system, set through
+	// PUT /users/by_external/{external_id}. It is unique when present.
+	ExternalID string `json:"external_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Friend is one side of a friendship as stored on a user. Since is when the
+// friendship was formed and Weight is its strength, e.g. an interaction
+// count; both sides carry the same values.
+type Friend struct {
+	ID     string    `json:"id"`
+	Since  time.Time `json:"since"`
+	Weight int       `json:"weight,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare ID string, the format friend lists had
+// before friendships were timestamped, so older state files still load.
+// Entries without a weight, bare or not, load with weight 0.
+func (f *Friend) UnmarshalJSON(data []byte) error {
+	var id string
+	if err := json.Unmarshal(data, &id); err == nil {
+		*f = Friend{ID: id}
+		return nil
+	}
+
+	type plain Friend
+	return json.Unmarshal(data, (*plain)(f))
+}
+
+func (u User) friendIDs() []string {
+	ids := make([]string, len(u.Friends))
+	for i, friend := range u.Friends {
+		ids[i] = friend.ID
+	}
+	return ids
+}
+
+// lastModified is UpdatedAt, or CreatedAt for users never modified since
+// UpdatedAt was introduced.
+func (u User) lastModified() time.Time {
+	if u.UpdatedAt.IsZero() {
+		return u.CreatedAt
+	}
+	return u.UpdatedAt
+}
+
+func (u User) hasFriend(id string) bool {
+	return slices.ContainsFunc(u.Friends, func(f Friend) bool { return f.ID == id })
 }
 
 var (
 	users      = make(map[string]User)
 	usersMutex = sync.RWMutex{}
 	nextUserID = 1
+
+	// clock is the time source for timestamps; tests swap in a fake.
+	clock = time.Now
 )
 
 func generateUserID() string {
@@ -28,150 +106,714 @@ func generateUserID() string {
 	return id
 }
 
+// decodeJSON reads a request body into v. Numbers bound to interface-typed
+// fields are kept as json.Number instead of float64, so values above 2^53
+// survive unchanged, and a number sent where a typed field expects something
+// else (say, an ID, which is always a string) is rejected rather than coerced.
+func decodeJSON(r *http.Request, v any) error {
+	return decodeBody(r.Body, v)
+}
+
+// decodeBody is decodeJSON for bodies that do not come straight from a
+// request, such as JSON-RPC params.
+func decodeBody(body io.Reader, v any) error {
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// wantsPretty reports whether the client asked for indented JSON through
+// ?pretty=true or an X-Pretty: true header.
+func wantsPretty(r *http.Request) bool {
+	for _, v := range []string{r.URL.Query().Get("pretty"), r.Header.Get("X-Pretty")} {
+		if pretty, err := strconv.ParseBool(v); err == nil && pretty {
+			return true
+		}
+	}
+	return false
+}
+
+// middlewareHeaders are the response headers set by middleware before the
+// handler runs. They describe the exchange rather than the body, so they are
+// kept when writeJSON replaces a response with an error.
+var middlewareHeaders = map[string]bool{
+	middleware.RequestIDHeader:      true,
+	"Vary":                          true,
+	"Access-Control-Allow-Origin":   true,
+	"Access-Control-Expose-Headers": true,
+	"Strict-Transport-Security":     true,
+}
+
+// writeJSON encodes v into memory before sending anything, so the response
+// always carries an exact Content-Length, HEAD requests included, and a
+// value that fails to encode turns into a clean 500 rather than a status
+// followed by half a body. Headers the handler set for the lost body, such
+// as X-Total-Count or Last-Modified, are dropped from that 500.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	if wantsPretty(r) {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("[%s] encode response: %v", middleware.GetReqID(r.Context()), err)
+		for name := range w.Header() {
+			if !middlewareHeaders[name] {
+				w.Header().Del(name)
+			}
+		}
+		httpError(w, r, http.StatusInternalServerError, "encode_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	var newUser User
-	if err := json.NewDecoder(r.Body).Decode(&newUser); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	request, qerr := decodeUserRequest(r.Header.Get(schemaVersionHeader), r.Body)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
 		return
 	}
+	newUser := request.toUser(clock().UTC())
 
 	usersMutex.Lock()
 	defer usersMutex.Unlock()
 
-	userID := generateUserID()
-	users[userID] = newUser
+	userID, qerr := insertUser(newUser, request.Friends)
+	if qerr != nil {
+		writeCreateError(w, r, qerr)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, "User ID: %s", userID)
+	fmt.Fprint(w, msg(r, "user_created", userID))
+}
+
+// writeCreateError answers a rejected new user: 409 for a duplicate, 400 for
+// anything wrong with the body.
+func writeCreateError(w http.ResponseWriter, r *http.Request, qerr *queryError) {
+	if qerr.id == "duplicate_user" {
+		httpError(w, r, http.StatusConflict, qerr.id)
+		return
+	}
+	writeQueryError(w, r, qerr)
+}
+
+// checkNewUser reports why newUser, befriending friendIDs, cannot be stored:
+// config.RejectDuplicates is set and the name and age are taken, or a friend
+// ID names no user or repeats. The caller must hold usersMutex.
+func checkNewUser(newUser User, friendIDs []string) *queryError {
+	if config.RejectDuplicates && usersByNameAge[nameAgeKey{newUser.Name, newUser.Age}] > 0 {
+		return &queryError{id: "duplicate_user"}
+	}
+
+	invalid := []string{}
+	seen := make(map[string]bool, len(friendIDs))
+	for _, friendID := range friendIDs {
+		if _, ok := users[friendID]; (!ok || seen[friendID]) && !slices.Contains(invalid, friendID) {
+			invalid = append(invalid, friendID)
+		}
+		seen[friendID] = true
+	}
+	if len(invalid) > 0 {
+		return &queryError{id: "invalid_friend_ids", args: []any{strings.Join(invalid, ", ")}}
+	}
+	return nil
+}
+
+// storeUser stores newUser under a fresh ID and befriends each of friendIDs
+// on both sides, which checkNewUser must have accepted. The caller must hold
+// usersMutex for writing.
+func storeUser(newUser User, friendIDs []string) string {
+	userID := generateUserID()
+	putUser(userID, newUser)
+	for _, friendID := range friendIDs {
+		addFriendship(userID, friendID)
+	}
+	return userID
+}
+
+// insertUser checks and stores newUser and records the undo, which removes
+// the user together with the friendships it was created with. Nothing is
+// stored when checkNewUser rejects it. The caller must hold usersMutex for
+// writing.
+func insertUser(newUser User, friendIDs []string) (string, *queryError) {
+	if qerr := checkNewUser(newUser, friendIDs); qerr != nil {
+		return "", qerr
+	}
+
+	userID := storeUser(newUser, friendIDs)
+	recordUndo("create", func() { removeUser(userID) })
+	return userID, nil
+}
+
+// upsertByExternalIDHandler creates the user with the given external ID, or
+// renames and re-ages the one that already has it, answering 201 or 200.
+// Friends in the body only apply on creation; updates keep the friend list,
+// and the email when none is given.
+func upsertByExternalIDHandler(w http.ResponseWriter, r *http.Request) {
+	externalID, qerr := pathParam(r, "external_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	request, qerr := decodeUserRequest(r.Header.Get(schemaVersionHeader), r.Body)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	if userID, exists := usersByExternalID[externalID]; exists {
+		user := users[userID]
+		if !checkUnmodifiedSince(w, r, user) {
+			return
+		}
+		user.Name = request.Name
+		user.Age = request.Age
+		if request.Email != "" {
+			user.Email = request.Email
+		}
+		putUser(userID, user)
+
+		writeJSON(w, r, http.StatusOK, toUserResponse(userID, user))
+		return
+	}
+
+	newUser := request.toUser(clock().UTC())
+	newUser.ExternalID = externalID
+	userID, qerr := insertUser(newUser, request.Friends)
+	if qerr != nil {
+		writeCreateError(w, r, qerr)
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, toUserResponse(userID, users[userID]))
 }
 
 func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	includeFriends, qerr := parseBoolParam(q, "include_friends", true)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	filter, qerr := parseUserFilter(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	fields, qerr := parseFields(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	anon, ok := parseAnonymize(w, r)
+	if !ok {
+		return
+	}
+
+	// By default users come back as an object keyed by ID. An explicit
+	// order returns an array instead, since object keys carry no order.
+	order := q.Get("order")
+	if order != "" && order != "registration" {
+		writeQueryError(w, r, invalidParam("order"))
+		return
+	}
+	// The cursor is an ID, so it only makes sense for the ID order.
+	if qerr := conflictingParams(q, "order", "after"); qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
 	usersMutex.RLock()
 	defer usersMutex.RUnlock()
 
 	if len(users) == 0 {
-		http.Error(w, "Список пользователей пуст", http.StatusNotFound)
+		httpError(w, r, http.StatusNotFound, "users_empty")
+		return
+	}
+	if _, exists := users[filter.friendOf]; filter.friendOf != "" && !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	ids := make([]string, 0, len(users))
+	for id, user := range users {
+		if filter.match(user) {
+			ids = append(ids, id)
+		}
+	}
+	sortIDs(ids)
+	if order == "registration" {
+		// IDs are sequential today; CreatedAt keeps the order right once
+		// they are not, with the ID sort above breaking ties.
+		sort.SliceStable(ids, func(i, j int) bool {
+			return users[ids[i]].CreatedAt.Before(users[ids[j]].CreatedAt)
+		})
+	}
+	setTotalCount(w, len(ids))
 
-	err := json.NewEncoder(w).Encode(users)
-	if err != nil {
-		http.Error(w, "Ошибка при формировании ответа", http.StatusInternalServerError)
+	pageIDs := paginate(afterCursor(ids, pg), pg)
+	listing := make([]any, 0, len(pageIDs))
+	for _, id := range pageIDs {
+		view := toUserResponse(id, users[id])
+		if !includeFriends {
+			view.Friends = []string{}
+		}
+		if anon != nil {
+			anon.apply(&view)
+		}
+		listing = append(listing, fields.project(view))
+	}
+
+	if order != "" {
+		writeJSON(w, r, http.StatusOK, listing)
 		return
 	}
+
+	byID := make(map[string]any, len(listing))
+	for i, view := range listing {
+		byID[pageIDs[i]] = view
+	}
+	writeJSON(w, r, http.StatusOK, byID)
 }
 
-func makeFriendsHandler(w http.ResponseWriter, r *http.Request) {
-	var friendship struct {
-		SourceID string `json:"source_id"`
-		TargetID string `json:"target_id"`
+// getUserIDsHandler lists user IDs only, sorted, one page at a time.
+func getUserIDsHandler(w http.ResponseWriter, r *http.Request) {
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
 	}
+	usersMutex.RUnlock()
 
-	if err := json.NewDecoder(r.Body).Decode(&friendship); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	sortIDs(ids)
+	setTotalCount(w, len(ids))
+
+	writeJSON(w, r, http.StatusOK, paginate(afterCursor(ids, pg), pg))
+}
+
+// getUserAtHandler returns the user at a 0-based position in ID order, so
+// tools can walk the dataset without knowing IDs. Positions shift as users
+// are created and deleted.
+func getUserAtHandler(w http.ResponseWriter, r *http.Request) {
+	param, qerr := pathParam(r, "index")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	index, err := strconv.Atoi(param)
+	if err != nil || index < 0 {
+		writeQueryError(w, r, invalidParam("index"))
 		return
 	}
 
-	usersMutex.Lock()
-	defer usersMutex.Unlock()
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	if index >= len(users) {
+		httpError(w, r, http.StatusNotFound, "index_out_of_range", index)
+		return
+	}
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
 
-	sourceUser, sourceExists := users[friendship.SourceID]
-	targetUser, targetExists := users[friendship.TargetID]
+	writeJSON(w, r, http.StatusOK, toUserResponse(ids[index], users[ids[index]]))
+}
 
-	if !sourceExists || !targetExists {
-		http.Error(w, "One or both users not found", http.StatusBadRequest)
+// getRecentUsersHandler lists users by last modification, newest first,
+// ties broken by ID.
+func getRecentUsersHandler(w http.ResponseWriter, r *http.Request) {
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := users[ids[i]].lastModified(), users[ids[j]].lastModified()
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return lessID(ids[i], ids[j])
+	})
+	setTotalCount(w, len(ids))
+
+	recent := []userResponse{}
+	for _, id := range paginate(ids, pg) {
+		recent = append(recent, toUserResponse(id, users[id]))
+	}
+	writeJSON(w, r, http.StatusOK, recent)
+}
+
+// getUserChangesHandler lists the users modified after ?since, oldest change
+// first and ties broken by ID, so a client can poll with the last
+// updated_at it saw. Deletions leave nothing behind and are not reported;
+// clients that need them must resync from /users/ids.
+func getUserChangesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !q.Has("since") {
+		writeQueryError(w, r, invalidParam("since"))
+		return
+	}
+	since, qerr := parseTimeParam(q, "since")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
 		return
 	}
 
-	sourceUser.Friends = append(sourceUser.Friends, friendship.TargetID)
-	targetUser.Friends = append(targetUser.Friends, friendship.SourceID)
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	ids := []string{}
+	for id, user := range users {
+		if user.lastModified().After(since) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := users[ids[i]].lastModified(), users[ids[j]].lastModified()
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return lessID(ids[i], ids[j])
+	})
+	setTotalCount(w, len(ids))
+
+	changed := []userResponse{}
+	for _, id := range paginate(ids, pg) {
+		changed = append(changed, toUserResponse(id, users[id]))
+	}
+	writeJSON(w, r, http.StatusOK, changed)
+}
+
+// addFriendship links two users in both directions and returns their updated
+// records. Both users are looked up here, under the same write lock as the
+// update, so a concurrent delete can never leave a dangling edge even if the
+// callers stop serializing on a single mutex. It changes nothing and returns
+// the catalog message explaining why when either user is missing or one has
+// blocked the other, so no caller can befriend a blocked pair. The caller
+// must hold usersMutex for writing.
+//
+// Invariant: a friend ID appears at most once in a friend list. The
+// membership check and the append below happen without releasing the lock in
+// between, so any number of concurrent identical requests still produce
+// exactly one entry on each side.
+func addFriendship(sourceID, targetID string) (User, User, string) {
+	sourceUser, sourceExists := users[sourceID]
+	targetUser, targetExists := users[targetID]
+	if !sourceExists || !targetExists {
+		return User{}, User{}, "users_not_found"
+	}
+	if blocks(sourceID, targetID) {
+		return User{}, User{}, "blocked"
+	}
+
+	if sourceUser.hasFriend(targetID) && targetUser.hasFriend(sourceID) {
+		return sourceUser, targetUser, ""
+	}
+
+	since := clock().UTC()
+	if !sourceUser.hasFriend(targetID) {
+		sourceUser.Friends = append(sourceUser.Friends, Friend{ID: targetID, Since: since})
+	}
+	if !targetUser.hasFriend(sourceID) {
+		targetUser.Friends = append(targetUser.Friends, Friend{ID: sourceID, Since: since})
+	}
+
+	putUser(sourceID, sourceUser)
+	putUser(targetID, targetUser)
+	return sourceUser, targetUser, ""
+}
+
+// areFriends reports whether targetID is on sourceID's friend list.
+// The caller must hold usersMutex.
+func areFriends(sourceID, targetID string) bool {
+	return users[sourceID].hasFriend(targetID)
+}
+
+const streamFlushEvery = 100
+
+func streamUsersHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.RLock()
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	usersMutex.RUnlock()
 
-	users[friendship.SourceID] = sourceUser
-	users[friendship.TargetID] = targetUser
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
 
+	w.Header().Set("Content-Type", "application/x-ndjson")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "%s и %s теперь друзья", sourceUser.Name, targetUser.Name)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	for i, id := range ids {
+		usersMutex.RLock()
+		user, exists := users[id]
+		line := toUserResponse(id, user)
+		usersMutex.RUnlock()
+
+		// Users deleted after the IDs were collected are skipped.
+		if !exists {
+			continue
+		}
+
+		if err := encoder.Encode(line); err != nil {
+			log.Printf("stream users: %v", err)
+			return
+		}
+		if flusher != nil && (i+1)%streamFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
 }
 
-func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
-	var request struct {
+func makeFriendsHandler(w http.ResponseWriter, r *http.Request) {
+	var friendship friendshipRequest
+
+	if err := decodeJSON(r, &friendship); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	// A self-loop would count as half an edge in degree-based aggregates.
+	if friendship.SourceID == friendship.TargetID {
+		httpError(w, r, http.StatusBadRequest, "self_friendship")
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	sourceUser, targetUser, created, errID := befriend(friendship.SourceID, friendship.TargetID)
+	switch errID {
+	case "":
+	case "blocked":
+		httpError(w, r, http.StatusConflict, errID)
+		return
+	default:
+		httpError(w, r, http.StatusBadRequest, errID)
+		return
+	}
+
+	// Repeating the call is harmless; created tells the two cases apart.
+	message := "now_friends"
+	if !created {
+		message = "already_friends"
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		SourceID string `json:"source_id"`
 		TargetID string `json:"target_id"`
+		Created  bool   `json:"created"`
+		Message  string `json:"message"`
+	}{friendship.SourceID, friendship.TargetID, created, msg(r, message, sourceUser.Name, targetUser.Name)})
+}
+
+// setFriendshipWeightHandler sets the weight of an existing friendship on
+// both sides.
+func setFriendshipWeightHandler(w http.ResponseWriter, r *http.Request) {
+	params, qerr := pathParams(r, "a", "b")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
 	}
+	sourceID, targetID := params[0], params[1]
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	var request weightRequest
+	if err := decodeJSON(r, &request); err != nil || request.Weight == nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	if *request.Weight < 0 {
+		httpError(w, r, http.StatusBadRequest, "negative_weight")
 		return
 	}
 
 	usersMutex.Lock()
 	defer usersMutex.Unlock()
 
-	targetUser, exists := users[request.TargetID]
-	if !exists {
-		http.Error(w, "User not found", http.StatusBadRequest)
+	sourceUser, sourceExists := users[sourceID]
+	targetUser, targetExists := users[targetID]
+	if !sourceExists || !targetExists {
+		httpError(w, r, http.StatusNotFound, "users_not_found")
+		return
+	}
+	if !sourceUser.hasFriend(targetID) || !targetUser.hasFriend(sourceID) {
+		httpError(w, r, http.StatusConflict, "not_friends")
 		return
 	}
 
-	delete(users, request.TargetID)
-
-	for _, friendID := range targetUser.Friends {
-		friend, ok := users[friendID]
-		if !ok {
-			continue
-		}
-		for i, id := range friend.Friends {
-			if id == request.TargetID {
-				friend.Friends = append(friend.Friends[:i], friend.Friends[i+1:]...)
-				break
+	setWeight := func(id string, user User, friendID string) {
+		user.Friends = slices.Clone(user.Friends)
+		for i := range user.Friends {
+			if user.Friends[i].ID == friendID {
+				user.Friends[i].Weight = *request.Weight
 			}
 		}
-		users[friendID] = friend
+		putUser(id, user)
 	}
+	setWeight(sourceID, sourceUser, targetID)
+	setWeight(targetID, targetUser, sourceID)
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "%s удалён", targetUser.Name)
+	writeJSON(w, r, http.StatusOK, struct {
+		Source string `json:"source"`
+		Target string `json:"target"`
+		Weight int    `json:"weight"`
+	}{sourceID, targetID, *request.Weight})
 }
 
-func getUserFriendsHandler(w http.ResponseWriter, r *http.Request) {
-	userID := chi.URLParam(r, "user_id")
+// befriend is addFriendship plus the undo record, which is only kept when
+// the friendship is new; created reports whether it was, that is whether
+// either side was missing. Undo removes only the sides added here, so a
+// half-edge that was already there stays. The caller must hold usersMutex
+// for writing.
+func befriend(sourceID, targetID string) (sourceUser, targetUser User, created bool, errID string) {
+	hadSource, hadTarget := areFriends(sourceID, targetID), areFriends(targetID, sourceID)
+	sourceUser, targetUser, errID = addFriendship(sourceID, targetID)
+	created = errID == "" && !(hadSource && hadTarget)
+	if created {
+		recordUndo("make_friends", func() {
+			if !hadSource {
+				removeFriendLink(sourceID, targetID)
+			}
+			if !hadTarget {
+				removeFriendLink(targetID, sourceID)
+			}
+		})
+	}
+	return sourceUser, targetUser, created, errID
+}
 
-	usersMutex.RLock()
-	defer usersMutex.RUnlock()
+func removeFriendID(friends []Friend, friendID string) []Friend {
+	for i, friend := range friends {
+		if friend.ID == friendID {
+			return append(friends[:i], friends[i+1:]...)
+		}
+	}
+	return friends
+}
 
+// clearFriends empties a user's friend list and removes the reverse edges
+// held by each former friend, returning how many friends were dropped.
+// The caller must hold usersMutex for writing.
+func clearFriends(userID string) int {
 	user, exists := users[userID]
 	if !exists {
-		http.Error(w, "User not found", http.StatusBadRequest)
-		return
+		return 0
 	}
 
-	friendsDetails := []User{}
-
-	for _, friendID := range user.Friends {
-		if friend, ok := users[friendID]; ok {
-			friendsDetails = append(friendsDetails, friend)
+	for _, friendID := range user.friendIDs() {
+		friend, ok := users[friendID]
+		if !ok || friendID == userID {
+			continue
 		}
+		friend.Friends = removeFriendID(friend.Friends, userID)
+		putUser(friendID, friend)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	removed := len(user.Friends)
+	user.Friends = []Friend{}
+	putUser(userID, user)
+	return removed
+}
 
-	err := json.NewEncoder(w).Encode(friendsDetails)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// removeUser deletes a user together with the reverse edges held by its
+// friends. The caller must hold usersMutex for writing.
+func removeUser(userID string) (User, bool) {
+	targetUser, exists := users[userID]
+	if !exists {
+		return User{}, false
 	}
+
+	clearFriends(userID)
+	dropUser(userID)
+	return targetUser, true
 }
 
-func updateUserAgeHandler(w http.ResponseWriter, r *http.Request) {
-	userID := chi.URLParam(r, "user_id")
+// removeFriendship drops one edge between two users in both directions.
+// The caller must hold usersMutex for writing.
+func removeFriendship(sourceID, targetID string) {
+	removeFriendLink(sourceID, targetID)
+	removeFriendLink(targetID, sourceID)
+}
 
-	var request struct {
-		NewAge int `json:"new_age"`
+// removeFriendLink drops friendID from userID's friend list only.
+// The caller must hold usersMutex for writing.
+func removeFriendLink(userID, friendID string) {
+	if user, ok := users[userID]; ok {
+		user.Friends = removeFriendID(user.Friends, friendID)
+		putUser(userID, user)
 	}
+}
+
+// missingUsers returns the IDs from ids that do not belong to any user, in
+// input order and without repeats. The caller must hold usersMutex.
+func missingUsers(ids []string) []string {
+	missing := []string{}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if _, ok := users[id]; ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		missing = append(missing, id)
+	}
+	return missing
+}
+
+// replaceFriendsHandler swaps a user's whole friend list. Every referenced ID
+// is validated before anything is touched, so an invalid or blocked entry
+// rejects the request without adding or removing a single edge.
+func replaceFriendsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	var request replaceFriendsRequest
 
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeJSON(r, &request); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
 		return
 	}
 
@@ -180,26 +822,819 @@ func updateUserAgeHandler(w http.ResponseWriter, r *http.Request) {
 
 	user, exists := users[userID]
 	if !exists {
-		http.Error(w, "User not found", http.StatusBadRequest)
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+	if !checkUnmodifiedSince(w, r, user) {
 		return
 	}
 
-	user.Age = request.NewAge
-	users[userID] = user
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Возраст пользователя успешно обновлён")
-}
-
-func main() {
+	invalid := missingUsers(request.FriendIDs)
+	if slices.Contains(request.FriendIDs, userID) {
+		invalid = append(invalid, userID)
+	}
+	if len(invalid) > 0 {
+		httpError(w, r, http.StatusBadRequest, "invalid_friend_ids", strings.Join(invalid, ", "))
+		return
+	}
+	var blocked []string
+	for _, friendID := range request.FriendIDs {
+		if blocks(userID, friendID) && !slices.Contains(blocked, friendID) {
+			blocked = append(blocked, friendID)
+		}
+	}
+	if len(blocked) > 0 {
+		httpError(w, r, http.StatusConflict, "blocked_friend_ids", strings.Join(blocked, ", "))
+		return
+	}
+
+	clearFriends(userID)
+	added := make(map[string]bool)
+	for _, friendID := range request.FriendIDs {
+		if added[friendID] {
+			continue
+		}
+		added[friendID] = true
+		addFriendship(userID, friendID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, msg(r, "friends_replaced", len(added)))
+}
+
+// clearFriendsHandler removes every friendship of a user, on both sides,
+// and keeps the user. Like replacing the friend list it is not recorded for
+// undo.
+func clearFriendsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+	if !checkUnmodifiedSince(w, r, user) {
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID  string `json:"user_id"`
+		Removed int    `json:"removed"`
+	}{userID, clearFriends(userID)})
+}
+
+// mergeUsersHandler moves every friendship of one user onto another and then
+// deletes the source user, all under a single write lock. Friends that block
+// or are blocked by the target user are not carried over.
+func mergeUsersHandler(w http.ResponseWriter, r *http.Request) {
+	params, qerr := pathParams(r, "from", "to")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	fromID, toID := params[0], params[1]
+
+	if fromID == toID {
+		httpError(w, r, http.StatusBadRequest, "merge_into_self")
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	fromUser, fromExists := users[fromID]
+	_, toExists := users[toID]
+	if !fromExists || !toExists {
+		httpError(w, r, http.StatusNotFound, "users_not_found")
+		return
+	}
+
+	for _, friendID := range fromUser.friendIDs() {
+		if friendID == toID || friendID == fromID || areFriends(toID, friendID) || blocks(toID, friendID) {
+			continue
+		}
+		addFriendship(toID, friendID)
+	}
+	removeUser(fromID)
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID      string `json:"user_id"`
+		FriendCount int    `json:"friend_count"`
+	}{toID, len(users[toID].Friends)})
+}
+
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	var request deleteUserRequest
+
+	if err := decodeJSON(r, &request); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	// Deleting a missing user is not an error, so retried deletes are safe.
+	deleteUser(request.TargetID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUser is removeUser plus the undo record, reporting whether the user
+// existed. The caller must hold usersMutex for writing.
+func deleteUser(userID string) bool {
+	targetUser, removed := removeUser(userID)
+	if removed {
+		recordUndo("delete", func() { reinsertUser(userID, targetUser) })
+	}
+	return removed
+}
+
+type deleteResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// deleteUsersBatchHandler deletes a list of users under one lock. It is
+// best-effort: missing IDs are reported as not_found and do not stop the
+// rest of the batch. The whole batch is undone as one operation.
+func deleteUsersBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var request []string
+	if err := decodeJSON(r, &request); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	type removed struct {
+		id   string
+		user User
+	}
+	var deleted []removed
+	results := make([]deleteResult, 0, len(request))
+	for _, id := range request {
+		user, ok := removeUser(id)
+		if !ok {
+			results = append(results, deleteResult{id, "not_found"})
+			continue
+		}
+		deleted = append(deleted, removed{id, user})
+		results = append(results, deleteResult{id, "deleted"})
+	}
+
+	if len(deleted) > 0 {
+		// Reinserting in reverse order restores edges between users of the
+		// same batch: each stored record still lists the users deleted after it.
+		recordUndo("delete_batch", func() {
+			for i := len(deleted) - 1; i >= 0; i-- {
+				reinsertUser(deleted[i].id, deleted[i].user)
+			}
+		})
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Deleted int            `json:"deleted"`
+		Results []deleteResult `json:"results"`
+	}{len(deleted), results})
+}
+
+func getUserFriendsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	// Only the links to existing friends are read up front, so the total and
+	// the pages agree; the requested page is then hydrated in one batched
+	// lookup, so high-degree users neither hold the lock while every friend
+	// is converted nor pay for friends off the page.
+	usersMutex.RLock()
+	user, exists := users[userID]
+	links := make([]Friend, 0, len(user.Friends))
+	for _, link := range user.Friends {
+		if _, ok := users[link.ID]; ok {
+			links = append(links, link)
+		}
+	}
+	usersMutex.RUnlock()
+
+	if !exists {
+		httpError(w, r, http.StatusBadRequest, "user_not_found")
+		return
+	}
+	setTotalCount(w, len(links))
+
+	links = paginate(links, pg)
+	weights := make(map[string]int, len(links))
+	ids := make([]string, len(links))
+	for i, link := range links {
+		weights[link.ID] = link.Weight
+		ids[i] = link.ID
+	}
+
+	friends := []friendResponse{}
+	for _, view := range lookupUsers(ids) {
+		friends = append(friends, friendResponse{view, weights[view.ID]})
+	}
+	writeJSON(w, r, http.StatusOK, friends)
+}
+
+// getFriendIDsHandler pages through a user's friend IDs in ID order, without
+// hydrating the friends. next_offset is the offset of the following page, or
+// null on the last one; paging is by offset only.
+func getFriendIDsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Has("after") {
+		writeQueryError(w, r, invalidParam("after"))
+		return
+	}
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	user, exists := users[userID]
+	ids := []string{}
+	for _, friendID := range user.friendIDs() {
+		if _, ok := users[friendID]; ok {
+			ids = append(ids, friendID)
+		}
+	}
+	usersMutex.RUnlock()
+
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+	sortIDs(ids)
+	setTotalCount(w, len(ids))
+
+	var next *int
+	if end := pg.offset + pg.limit; end < len(ids) {
+		next = &end
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		IDs        []string `json:"ids"`
+		NextOffset *int     `json:"next_offset"`
+	}{paginate(ids, pg), next})
+}
+
+// getFriendsOfFriendHandler lists friend_id's friends, but only to a user
+// who is friends with friend_id: second-degree connections are visible
+// through one's own friends only.
+func getFriendsOfFriendHandler(w http.ResponseWriter, r *http.Request) {
+	params, qerr := pathParams(r, "user_id", "friend_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	userID, friendID := params[0], params[1]
+
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	user, userExists := users[userID]
+	friend, friendExists := users[friendID]
+	links := slices.Clone(friend.Friends)
+	usersMutex.RUnlock()
+
+	if !userExists || !friendExists {
+		httpError(w, r, http.StatusNotFound, "users_not_found")
+		return
+	}
+	if !user.hasFriend(friendID) {
+		httpError(w, r, http.StatusForbidden, "not_friends")
+		return
+	}
+	setTotalCount(w, len(links))
+
+	ids := make([]string, 0, len(links))
+	for _, link := range paginate(links, pg) {
+		ids = append(ids, link.ID)
+	}
+	writeJSON(w, r, http.StatusOK, lookupUsers(ids))
+}
+
+func getUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	fields, qerr := parseFields(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	anon, ok := parseAnonymize(w, r)
+	if !ok {
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists, err := userStore.GetUser(userID)
+	if err != nil {
+		log.Printf("[%s] get user %s: %v", middleware.GetReqID(r.Context()), userID, err)
+		httpError(w, r, http.StatusServiceUnavailable, "store_unavailable")
+		return
+	}
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	view := toUserResponse(userID, user)
+	if anon != nil {
+		anon.apply(&view)
+	}
+	w.Header().Set("Last-Modified", user.lastModified().UTC().Format(http.TimeFormat))
+	writeJSON(w, r, http.StatusOK, fields.project(view))
+}
+
+type friendSince struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Since  time.Time `json:"since"`
+	Weight int       `json:"weight"`
+}
+
+// getFriendsTimelineHandler lists the user's friends by when each friendship
+// was formed, newest first.
+func getFriendsTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	timeline := make([]friendSince, 0, len(user.Friends))
+	for _, link := range user.Friends {
+		if friend, ok := users[link.ID]; ok {
+			timeline = append(timeline, friendSince{link.ID, friend.Name, link.Since, link.Weight})
+		}
+	}
+	sort.Slice(timeline, func(i, j int) bool {
+		if !timeline[i].Since.Equal(timeline[j].Since) {
+			return timeline[i].Since.After(timeline[j].Since)
+		}
+		return lessID(timeline[i].ID, timeline[j].ID)
+	})
+	setTotalCount(w, len(timeline))
+
+	writeJSON(w, r, http.StatusOK, paginate(timeline, pg))
+}
+
+// embedFriends hydrates the existing users among ids, in ID order, up to
+// config.MaxEmbeddedFriends of them, and reports whether any were left out.
+// Views that embed friend objects go through it so a high-degree user
+// cannot blow up a response. The caller must hold usersMutex.
+func embedFriends(ids []string) ([]userResponse, bool) {
+	ids = slices.Clone(ids)
+	sortIDs(ids)
+
+	embedded := []userResponse{}
+	for _, id := range ids {
+		friend, ok := users[id]
+		if !ok {
+			continue
+		}
+		if len(embedded) == config.MaxEmbeddedFriends {
+			return embedded, true
+		}
+		embedded = append(embedded, toUserResponse(id, friend))
+	}
+	return embedded, false
+}
+
+func getFullUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	view := fullUserResponse{userResponse: toUserResponse(userID, user)}
+	view.Friends, view.FriendsTruncated = embedFriends(user.friendIDs())
+
+	writeJSON(w, r, http.StatusOK, view)
+}
+
+// getFollowersHandler lists the users whose friend list contains the given
+// user. Friendships are symmetric today, so this mirrors /friends/{user_id};
+// it scans every user and costs O(total friend list length) per call.
+func getFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	writeFollowers(w, r, userID)
+}
+
+// getUsersSharingFriendHandler lists the users who count friend_id as a
+// friend. It is /followers seen from the "people who know X" side.
+func getUsersSharingFriendHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "friend_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	writeFollowers(w, r, userID)
+}
+
+// writeFollowers lists, a page at a time, every user whose friend list
+// contains userID.
+func writeFollowers(w http.ResponseWriter, r *http.Request, userID string) {
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	if _, exists := users[userID]; !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	followers := []userResponse{}
+	for id, user := range users {
+		if user.hasFriend(userID) {
+			followers = append(followers, toUserResponse(id, user))
+		}
+	}
+	sort.Slice(followers, func(i, j int) bool { return lessID(followers[i].ID, followers[j].ID) })
+	setTotalCount(w, len(followers))
+
+	writeJSON(w, r, http.StatusOK, paginate(followers, pg))
+}
+
+const (
+	minAge = 0
+	maxAge = 150
+)
+
+func validAge(age int) bool {
+	return age >= minAge && age <= maxAge
+}
+
+// checkUnmodifiedSince enforces If-Unmodified-Since on an update of user,
+// writing 412 and reporting false when the user changed after the given
+// time. HTTP dates have whole-second precision, so the comparison drops the
+// sub-second part of UpdatedAt. A malformed header is ignored, as RFC 9110
+// requires.
+func checkUnmodifiedSince(w http.ResponseWriter, r *http.Request, user User) bool {
+	header := r.Header.Get("If-Unmodified-Since")
+	if header == "" {
+		return true
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return true
+	}
+	if user.lastModified().Truncate(time.Second).After(since) {
+		w.Header().Set("Last-Modified", user.lastModified().UTC().Format(http.TimeFormat))
+		httpError(w, r, http.StatusPreconditionFailed, "precondition_failed")
+		return false
+	}
+	return true
+}
+
+func updateUserAgeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	var request updateAgeRequest
+
+	if err := decodeJSON(r, &request); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	if id, args := request.validate(); id != "" {
+		httpError(w, r, http.StatusBadRequest, id, args...)
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	if user, exists := users[userID]; exists && !checkUnmodifiedSince(w, r, user) {
+		return
+	}
+	if _, ok := applyAgeUpdate(userID, request); !ok {
+		httpError(w, r, http.StatusBadRequest, "user_not_found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, msg(r, "age_updated"))
+}
+
+// applyAgeUpdate applies a validated age update and records its undo,
+// returning the updated user. It reports false when the user does not exist.
+// The caller must hold usersMutex for writing.
+func applyAgeUpdate(userID string, request updateAgeRequest) (User, bool) {
+	user, exists := users[userID]
+	if !exists {
+		return User{}, false
+	}
+
+	oldAge := user.Age
+	if request.NewAge != nil {
+		user.Age = *request.NewAge
+	} else {
+		user.Age = min(max(user.Age+*request.Delta, minAge), maxAge)
+	}
+	putUser(userID, user)
+	recordUndo("update_age", func() {
+		if user, ok := users[userID]; ok {
+			user.Age = oldAge
+			putUser(userID, user)
+		}
+	})
+	return user, true
+}
+
+type invalidEntry struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// updateAgesHandler applies a batch of absolute age updates under one lock.
+// The batch is all-or-nothing: any invalid entry rejects every update.
+func updateAgesHandler(w http.ResponseWriter, r *http.Request) {
+	var request []ageUpdateEntry
+
+	if err := decodeJSON(r, &request); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	invalid := []invalidEntry{}
+	seen := make(map[string]bool, len(request))
+	for i, entry := range request {
+		switch {
+		case seen[entry.ID]:
+			invalid = append(invalid, invalidEntry{i, entry.ID, msg(r, "duplicate_id")})
+		case !validAge(entry.NewAge):
+			invalid = append(invalid, invalidEntry{i, entry.ID, msg(r, "age_out_of_range", minAge, maxAge)})
+		default:
+			if _, exists := users[entry.ID]; !exists {
+				invalid = append(invalid, invalidEntry{i, entry.ID, msg(r, "user_not_found")})
+			}
+		}
+		seen[entry.ID] = true
+	}
+	if len(invalid) > 0 {
+		countValidationError(r)
+		writeJSON(w, r, http.StatusBadRequest, struct {
+			errorResponse
+			Invalid []invalidEntry `json:"invalid"`
+		}{newErrorResponse(r, "batch_rejected"), invalid})
+		return
+	}
+
+	oldAges := make(map[string]int, len(request))
+	for _, entry := range request {
+		user := users[entry.ID]
+		oldAges[entry.ID] = user.Age
+		user.Age = entry.NewAge
+		putUser(entry.ID, user)
+	}
+	recordUndo("update_ages", func() {
+		for id, age := range oldAges {
+			if user, ok := users[id]; ok {
+				user.Age = age
+				putUser(id, user)
+			}
+		}
+	})
+
+	writeJSON(w, r, http.StatusOK, struct {
+		Updated int `json:"updated"`
+	}{len(request)})
+}
+
+// newRouter builds the API with its middleware and routes. Middleware that
+// reads config does so here, so config must be final before it is called.
+func newRouter() *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(canonicalPath)
+	r.Use(hsts)
+	r.Use(cors)
+	r.Use(middleware.RequestID)
+	r.Use(exposeRequestID)
+	r.Use(logBodies)
+	r.Use(trackInFlight)
+	r.Use(recordMetrics)
+	r.Use(logSlowRequests)
+	r.Use(limitURILength(config.MaxURILength))
+	// HEAD is served by the GET handlers; net/http drops the body.
+	r.Use(middleware.GetHead)
+	r.Use(limitConcurrency(config.MaxConcurrentRequests))
+	r.Use(rejectWrites)
+	r.Use(limitDuration(r))
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, r, http.StatusNotFound, "not_found")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, r, http.StatusMethodNotAllowed, "method_not_allowed")
+	})
+
+	r.Get("/metrics", metricsHandler)
 
-	r.Post("/create", createUserHandler)
-	r.Post("/make_friends", makeFriendsHandler)
-	r.Delete("/user", deleteUserHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(requireJSON)
+
+		r.Post("/create", createUserHandler)
+		r.Post("/make_friends", makeFriendsHandler)
+		r.Delete("/user", deleteUserHandler)
+		r.Put("/user_age/{user_id}", updateUserAgeHandler)
+		r.Put("/friends/{user_id}", replaceFriendsHandler)
+		r.Post("/users/update_ages", updateAgesHandler)
+		r.Post("/users/delete_batch", deleteUsersBatchHandler)
+		r.Post("/users/query", queryUsersHandler)
+		r.Put("/users/by_external/{external_id}", upsertByExternalIDHandler)
+		r.Post("/friends/{a}/{b}/weight", setFriendshipWeightHandler)
+		r.Post("/rpc", rpcHandler)
+	})
+
+	r.Post("/users/import", importUsersHandler)
+	r.Post("/users/bulk_stream", bulkStreamHandler)
+	r.Post("/users/{from}/merge_into/{to}", mergeUsersHandler)
+	r.Post("/user/{user_id}/block/{target_id}", blockUserHandler)
+	r.Delete("/user/{user_id}/block/{target_id}", unblockUserHandler)
+
+	r.Delete("/friends/{user_id}", clearFriendsHandler)
 	r.Get("/friends/{user_id}", getUserFriendsHandler)
+	r.Get("/friends/{user_id}/by_age", getFriendsByAgeHandler)
+	r.Get("/followers/{user_id}", getFollowersHandler)
+	r.Get("/user/{user_id}", getUserHandler)
+	r.Get("/user/{user_id}/full", getFullUserHandler)
+	r.Get("/user/{user_id}/friends/timeline", getFriendsTimelineHandler)
+	r.Get("/user/{user_id}/friends/ranked", getRankedFriendsHandler)
+	r.Get("/user/{user_id}/friends/ids", getFriendIDsHandler)
+	r.Get("/user/{user_id}/closest_age_friend", getClosestAgeFriendHandler)
+	r.Get("/user/{user_id}/friend_stats", getFriendStatsHandler)
+	r.Get("/user/{user_id}/friends/{friend_id}/friends", getFriendsOfFriendHandler)
+	r.Get("/user/{user_id}/most_similar", getMostSimilarHandler)
 	r.Get("/users", getAllUsersHandler)
-	r.Put("/user_age/{user_id}", updateUserAgeHandler)
+	r.With(requireFeature("stream")).Get("/users/stream", streamUsersHandler)
+	r.With(requireFeature("sample")).Get("/users/sample", getUsersSampleHandler)
+	r.Get("/users/recent", getRecentUsersHandler)
+	r.Get("/users/changes", getUserChangesHandler)
+	r.Get("/users/ids", getUserIDsHandler)
+	r.Get("/users/at/{index}", getUserAtHandler)
+	r.Get("/users/sharing_friend/{friend_id}", getUsersSharingFriendHandler)
+	r.Get("/graph/edges", getGraphEdgesHandler)
+	r.Get("/graph/edge_count", getEdgeCountHandler)
+	r.Get("/graph/degree_distribution", getDegreeDistributionHandler)
+	r.Get("/similarity/{a}/{b}", getSimilarityHandler)
+	r.With(requireFeature("recommendations")).Get("/recommendations/{user_id}", getRecommendationsHandler)
+	r.With(requireFeature("recommendations")).Get("/recommendations/{user_id}/by_age", getAgeRecommendationsHandler)
+	r.With(requireFeature("recommendations")).Get("/user/{user_id}/candidates", getCandidatesHandler)
+
+	r.Group(func(r chi.Router) {
+		// Traversals get their own, smaller budget so a burst of them cannot
+		// starve the cheap CRUD routes.
+		r.Use(requireFeature("graph_analytics"))
+		r.Use(limitConcurrency(config.MaxConcurrentGraphRequests))
+
+		r.Get("/user/{user_id}/reach", getUserReachHandler)
+		r.Get("/graph/strong_pairs", getStrongPairsHandler)
+		r.Get("/graph/central", getCentralUsersHandler)
+		r.Get("/user/{user_id}/longest_chain", getLongestChainHandler)
+		r.Get("/user/{user_id}/subgraph", getSubgraphHandler)
+		r.Get("/user/{user_id}/exactly/{n}", getExactDistanceHandler)
+		r.Get("/graph/metrics", getGraphMetricsHandler)
+		r.Get("/user/{user_id}/clustering", getUserClusteringHandler)
+		r.Get("/user/{user_id}/clique", getUserCliqueHandler)
+		r.Get("/relationship/{a}/{b}", getRelationshipHandler)
+		r.Get("/graph/matrix", getAdjacencyMatrixHandler)
+		r.Get("/graph/triangles", getTrianglesHandler)
+		r.Get("/graph/pagerank", getPageRankHandler)
+	})
 
-	http.ListenAndServe(":8080", r)
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(adminOnly)
+
+		r.Get("/snapshot", snapshotHandler)
+		r.Get("/validate", validateHandler)
+		r.Get("/orphan_edges", getOrphanEdgesHandler)
+		r.Delete("/orphan_edges", deleteOrphanEdgesHandler)
+		r.With(requireJSON).Post("/restore", restoreHandler)
+		r.Post("/undo", undoHandler)
+		r.Post("/purge_inactive", purgeInactiveHandler)
+		r.Post("/maintenance", maintenanceHandler)
+	})
+
+	return r
+}
+
+func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	config = cfg
+	setFeatures(config.Features)
+	maintenance.Store(config.Maintenance)
+	reloadFeaturesOnHUP(*configPath)
+
+	if config.StateFile != "" {
+		if err := loadState(config.StateFile); err != nil {
+			log.Fatalf("state: %v", err)
+		}
+	}
+
+	r := newRouter()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	servers := []*http.Server{newServer(r)}
+	if config.HTTPRedirectAddr != "" {
+		servers = append(servers, newRedirectServer())
+	}
+	if config.SnapshotInterval > 0 {
+		go snapshotPeriodically(ctx, config.StateFile, time.Duration(config.SnapshotInterval))
+		onShutdown("snapshot", time.Duration(config.ShutdownHookTimeout), func(context.Context) error {
+			return saveState(config.StateFile)
+		})
+	}
+
+	err = serve(ctx, time.Duration(config.ShutdownTimeout), servers...)
+	runShutdownHooks()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
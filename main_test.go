@@ -0,0 +1,1355 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// resetState empties the store and puts back the default config, clock,
+// feature flags and maintenance mode, so every test starts from a fresh
+// server.
+func resetState(t *testing.T) {
+	t.Helper()
+
+	usersMutex.Lock()
+	replaceUsers(make(map[string]User))
+	nextUserID = 1
+	undoLog = nil
+	usersMutex.Unlock()
+
+	config = defaultConfig()
+	clock = time.Now
+	setFeatures(nil)
+	maintenance.Store(false)
+}
+
+// fakeClock is a settable time source swapped in for clock.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// useFakeClock makes clock return start until the returned clock is moved.
+func useFakeClock(start time.Time) *fakeClock {
+	c := &fakeClock{now: start}
+	clock = c.Now
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// do sends a request through h and returns the recorded response. A JSON
+// Content-Type is set when there is a body; header holds further name,
+// value pairs, which may override it.
+func do(t *testing.T, h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// expectStatus fails the test unless rec has the wanted status.
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, want, rec.Body)
+	}
+}
+
+// decodeResponse decodes a JSON response body into a value of type T.
+func decodeResponse[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body, err)
+	}
+	return v
+}
+
+// createUser creates a user through /create and returns its ID.
+func createUser(t *testing.T, h http.Handler, name string, age int) string {
+	t.Helper()
+	body, _ := json.Marshal(createUserRequest{Name: name, Age: age})
+	rec := do(t, h, http.MethodPost, "/create", string(body))
+	expectStatus(t, rec, http.StatusCreated)
+	return strings.TrimPrefix(rec.Body.String(), "User ID: ")
+}
+
+// makeFriends befriends each consecutive pair of ids through /make_friends.
+func makeFriends(t *testing.T, h http.Handler, ids ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(ids); i += 2 {
+		body, _ := json.Marshal(friendshipRequest{SourceID: ids[i], TargetID: ids[i+1]})
+		expectStatus(t, do(t, h, http.MethodPost, "/make_friends", string(body)), http.StatusOK)
+	}
+}
+
+func TestConcurrentDeleteAndMakeFriendsLeaveNoDanglingEdges(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	const pairs = 50
+	ids := make([]string, 0, 2*pairs)
+	for i := 0; i < 2*pairs; i++ {
+		ids = append(ids, createUser(t, h, "u"+strconv.Itoa(i), 20))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < pairs; i++ {
+		a, b := ids[2*i], ids[2*i+1]
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			do(t, h, http.MethodPost, "/make_friends", `{"source_id":"`+a+`","target_id":"`+b+`"}`)
+		}()
+		go func() {
+			defer wg.Done()
+			do(t, h, http.MethodPost, "/make_friends", `{"source_id":"`+b+`","target_id":"`+a+`"}`)
+		}()
+		go func() {
+			defer wg.Done()
+			do(t, h, http.MethodDelete, "/user", `{"target_id":"`+a+`"}`)
+		}()
+	}
+	wg.Wait()
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	if report := checkIntegrity(users); !report.Valid {
+		t.Errorf("integrity violations: %+v", report.Violations)
+	}
+	for i := 0; i < pairs; i++ {
+		if _, exists := users[ids[2*i]]; exists {
+			t.Errorf("user %s survived its delete", ids[2*i])
+		}
+	}
+}
+
+func TestStreamUsers(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	const count = 2*streamFlushEvery + 5
+	for i := 0; i < count; i++ {
+		createUser(t, h, "u"+strconv.Itoa(i), 20)
+	}
+
+	rec := do(t, h, http.MethodGet, "/users/stream", "")
+	expectStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+
+	scanner := bufio.NewScanner(rec.Body)
+	lines := 0
+	for scanner.Scan() {
+		var user userResponse
+		if err := json.Unmarshal(scanner.Bytes(), &user); err != nil {
+			t.Fatalf("line %d: %v", lines+1, err)
+		}
+		lines++
+		if want := strconv.Itoa(lines); user.ID != want {
+			t.Fatalf("line %d has user %s, want %s", lines, user.ID, want)
+		}
+	}
+	if lines != count {
+		t.Errorf("streamed %d users, want %d", lines, count)
+	}
+}
+
+func TestReplaceFriendsIsAtomic(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	a, b, c, d := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20), createUser(t, h, "d", 20)
+	makeFriends(t, h, a, b)
+
+	rec := do(t, h, http.MethodPut, "/friends/"+a, `{"friend_ids":["`+c+`","404","`+d+`"]}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if got := decodeResponse[errorResponse](t, rec).Error; got != "Invalid friend IDs: 404" {
+		t.Errorf("error = %q, want the offending ID listed", got)
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	if got := users[a].friendIDs(); len(got) != 1 || got[0] != b {
+		t.Errorf("user %s friends = %v, want [%s] unchanged", a, got, b)
+	}
+	for _, id := range []string{c, d} {
+		if len(users[id].Friends) != 0 {
+			t.Errorf("user %s gained friends %v from a rejected replace", id, users[id].friendIDs())
+		}
+	}
+}
+
+func TestReplaceFriends(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	a, b, c := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20)
+	makeFriends(t, h, a, b)
+
+	expectStatus(t, do(t, h, http.MethodPut, "/friends/"+a, `{"friend_ids":["`+c+`","`+c+`"]}`), http.StatusOK)
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	if got := users[a].friendIDs(); len(got) != 1 || got[0] != c {
+		t.Errorf("user %s friends = %v, want [%s]", a, got, c)
+	}
+	if len(users[b].Friends) != 0 || !users[c].hasFriend(a) {
+		t.Errorf("reverse edges not updated: b %v, c %v", users[b].friendIDs(), users[c].friendIDs())
+	}
+}
+
+func TestListUsersWithoutFriends(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	hub := createUser(t, h, "hub", 20)
+	for i := 0; i < 20; i++ {
+		makeFriends(t, h, hub, createUser(t, h, "u"+strconv.Itoa(i), 20))
+	}
+
+	full := do(t, h, http.MethodGet, "/users", "")
+	light := do(t, h, http.MethodGet, "/users?include_friends=false", "")
+	expectStatus(t, full, http.StatusOK)
+	expectStatus(t, light, http.StatusOK)
+	if light.Body.Len() >= full.Body.Len() {
+		t.Errorf("include_friends=false body is %d bytes, not smaller than %d", light.Body.Len(), full.Body.Len())
+	}
+	for id, user := range decodeResponse[map[string]userResponse](t, light) {
+		if len(user.Friends) != 0 {
+			t.Errorf("user %s lists friends %v", id, user.Friends)
+		}
+	}
+
+	// The stored friend lists are untouched.
+	again := do(t, h, http.MethodGet, "/users", "")
+	if got := decodeResponse[map[string]userResponse](t, again)[hub]; len(got.Friends) != 20 {
+		t.Errorf("hub has %d friends after a light listing, want 20", len(got.Friends))
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/users?include_friends=maybe", ""), http.StatusBadRequest)
+}
+
+func TestDeleteIsIdempotent(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 20)
+	makeFriends(t, h, a, b)
+
+	for i := 0; i < 2; i++ {
+		rec := do(t, h, http.MethodDelete, "/user", `{"target_id":"`+a+`"}`)
+		expectStatus(t, rec, http.StatusNoContent)
+		if rec.Body.Len() != 0 {
+			t.Errorf("delete %d: body = %q, want none", i+1, rec.Body)
+		}
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+a, ""), http.StatusNotFound)
+	if friends := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+b, "")).Friends; len(friends) != 0 {
+		t.Errorf("user %s still lists %v", b, friends)
+	}
+}
+
+func TestListUsersCreatedWithin(t *testing.T) {
+	resetState(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeClock(start)
+	h := newRouter()
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		createUser(t, h, name, 20)
+		fake.Advance(time.Hour)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"created_after=2024-03-01T12:30:00Z", []string{"2", "3", "4"}},
+		{"created_before=2024-03-01T13:30:00Z", []string{"1", "2"}},
+		{"created_after=2024-03-01T12:30:00Z&created_before=2024-03-01T14:30:00Z", []string{"2", "3"}},
+		{"created_after=2024-03-01T12:30:00Z&limit=2", []string{"2", "3"}},
+		{"created_after=2024-03-01T12:30:00Z&limit=1&offset=1", []string{"3"}},
+		{"created_after=2024-03-02T00:00:00Z", []string{}},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, "/users?order=registration&"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		got := []string{}
+		for _, user := range decodeResponse[[]userResponse](t, rec) {
+			got = append(got, user.ID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{
+		"created_after=yesterday",
+		"created_before=2024-03-01",
+		"created_after=2024-03-02T00:00:00Z&created_before=2024-03-01T00:00:00Z",
+	} {
+		expectStatus(t, do(t, h, http.MethodGet, "/users?"+query, ""), http.StatusBadRequest)
+	}
+}
+
+func TestMergeUsers(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	from, to := createUser(t, h, "from", 20), createUser(t, h, "to", 20)
+	shared, onlyFrom, onlyTo := createUser(t, h, "shared", 20), createUser(t, h, "only from", 20), createUser(t, h, "only to", 20)
+	makeFriends(t, h, from, to, from, shared, from, onlyFrom, to, shared, to, onlyTo)
+
+	rec := do(t, h, http.MethodPost, "/users/"+from+"/merge_into/"+to, "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[struct {
+		FriendCount int `json:"friend_count"`
+	}](t, rec)
+	if got.FriendCount != 3 {
+		t.Errorf("friend_count = %d, want 3", got.FriendCount)
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	if _, exists := users[from]; exists {
+		t.Errorf("user %s still exists after the merge", from)
+	}
+	if report := checkIntegrity(users); !report.Valid {
+		t.Errorf("integrity violations after the merge: %+v", report.Violations)
+	}
+	want := []string{shared, onlyFrom, onlyTo}
+	if ids := users[to].friendIDs(); !sameIDs(ids, want) {
+		t.Errorf("user %s friends = %v, want %v", to, ids, want)
+	}
+}
+
+func TestMergeUsersRejects(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a := createUser(t, h, "a", 20)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/users/"+a+"/merge_into/"+a, ""), http.StatusBadRequest)
+	expectStatus(t, do(t, h, http.MethodPost, "/users/"+a+"/merge_into/404", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+a, ""), http.StatusOK)
+}
+
+// sameIDs reports whether got and want hold the same IDs in any order.
+func sameIDs(got, want []string) bool {
+	got, want = slices.Clone(got), slices.Clone(want)
+	sortIDs(got)
+	sortIDs(want)
+	return slices.Equal(got, want)
+}
+
+// userAge reads a user's age back through the API.
+func userAge(t *testing.T, h http.Handler, id string) int {
+	t.Helper()
+	rec := do(t, h, http.MethodGet, "/user/"+id, "")
+	expectStatus(t, rec, http.StatusOK)
+	return decodeResponse[userResponse](t, rec).Age
+}
+
+func TestUpdateAgeByDelta(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	id := createUser(t, h, "a", 30)
+
+	steps := []struct {
+		body string
+		want int
+	}{
+		{`{"delta":1}`, 31},
+		{`{"delta":-5}`, 26},
+		{`{"new_age":40}`, 40},
+		{`{"delta":1000}`, maxAge},
+		{`{"delta":-1000}`, minAge},
+	}
+	for _, step := range steps {
+		expectStatus(t, do(t, h, http.MethodPut, "/user_age/"+id, step.body), http.StatusOK)
+		if got := userAge(t, h, id); got != step.want {
+			t.Errorf("after %s: age = %d, want %d", step.body, got, step.want)
+		}
+	}
+}
+
+func TestUpdateAgeNeedsExactlyOneOfNewAgeAndDelta(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	id := createUser(t, h, "a", 30)
+
+	for _, body := range []string{`{}`, `{"new_age":31,"delta":1}`, `{"new_age":null,"delta":null}`} {
+		rec := do(t, h, http.MethodPut, "/user_age/"+id, body)
+		expectStatus(t, rec, http.StatusBadRequest)
+		if got := decodeResponse[errorResponse](t, rec).Error; got != messages["en"]["age_or_delta"] {
+			t.Errorf("%s: error = %q", body, got)
+		}
+	}
+	if got := userAge(t, h, id); got != 30 {
+		t.Errorf("age = %d after rejected updates, want 30", got)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	id := createUser(t, h, "a", 20)
+
+	tests := []struct {
+		target string
+		header []string
+		pretty bool
+	}{
+		{"/user/" + id, nil, false},
+		{"/user/" + id + "?pretty=true", nil, true},
+		{"/user/" + id + "?pretty=false", nil, false},
+		{"/user/" + id, []string{"X-Pretty", "true"}, true},
+		{"/users", []string{"X-Pretty", "1"}, true},
+		{"/user/404?pretty=true", nil, true},
+	}
+	for _, tt := range tests {
+		body := do(t, h, http.MethodGet, tt.target, "", tt.header...).Body.String()
+		if indented := strings.Contains(body, "\n  \""); indented != tt.pretty {
+			t.Errorf("%s %v: indented = %v, want %v; body: %s", tt.target, tt.header, indented, tt.pretty, body)
+		}
+	}
+}
+
+func TestUpdateAgesIsAllOrNothing(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 30)
+
+	rec := do(t, h, http.MethodPost, "/users/update_ages",
+		`[{"id":"`+a+`","new_age":21},{"id":"`+b+`","new_age":200},{"id":"404","new_age":40},{"id":"`+a+`","new_age":22}]`)
+	expectStatus(t, rec, http.StatusBadRequest)
+	got := decodeResponse[struct {
+		Invalid []invalidEntry `json:"invalid"`
+	}](t, rec)
+	if len(got.Invalid) != 3 || got.Invalid[0].Index != 1 || got.Invalid[1].Index != 2 || got.Invalid[2].Index != 3 {
+		t.Errorf("invalid = %+v, want entries 1, 2 and 3", got.Invalid)
+	}
+	if userAge(t, h, a) != 20 || userAge(t, h, b) != 30 {
+		t.Error("a rejected batch changed ages")
+	}
+
+	rec = do(t, h, http.MethodPost, "/users/update_ages", `[{"id":"`+a+`","new_age":21},{"id":"`+b+`","new_age":31}]`)
+	expectStatus(t, rec, http.StatusOK)
+	if updated := decodeResponse[struct{ Updated int }](t, rec).Updated; updated != 2 {
+		t.Errorf("updated = %d, want 2", updated)
+	}
+	if userAge(t, h, a) != 21 || userAge(t, h, b) != 31 {
+		t.Error("batch was not applied")
+	}
+}
+
+// responseIDs lists the IDs of a JSON array of users, in order.
+func responseIDs(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	ids := []string{}
+	for _, user := range decodeResponse[[]userResponse](t, rec) {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
+func TestFollowers(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	me, a, b := createUser(t, h, "me", 20), createUser(t, h, "a", 20), createUser(t, h, "b", 20)
+	createUser(t, h, "stranger", 20)
+	makeFriends(t, h, me, b, a, me)
+
+	rec := do(t, h, http.MethodGet, "/followers/"+me, "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := responseIDs(t, rec); !slices.Equal(got, []string{a, b}) {
+		t.Errorf("followers = %v, want [%s %s]", got, a, b)
+	}
+
+	// A one-sided entry, as damaged state may hold, shows up only here.
+	usersMutex.Lock()
+	user := users["4"]
+	user.Friends = append(user.Friends, Friend{ID: me})
+	putUser("4", user)
+	usersMutex.Unlock()
+	if got := responseIDs(t, do(t, h, http.MethodGet, "/followers/"+me, "")); !slices.Equal(got, []string{a, b, "4"}) {
+		t.Errorf("followers = %v, want the one-sided follower too", got)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/followers/404", ""), http.StatusNotFound)
+}
+
+type fullUser struct {
+	ID               string         `json:"id"`
+	Name             string         `json:"name"`
+	Friends          []userResponse `json:"friends"`
+	FriendsTruncated bool           `json:"friends_truncated"`
+}
+
+func TestFullUser(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	me, a, b := createUser(t, h, "me", 20), createUser(t, h, "a", 31), createUser(t, h, "b", 42)
+	makeFriends(t, h, me, b, me, a, a, b)
+
+	rec := do(t, h, http.MethodGet, "/user/"+me+"/full", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[fullUser](t, rec)
+	if got.ID != me || got.Name != "me" || got.FriendsTruncated {
+		t.Errorf("user = %+v", got)
+	}
+	if len(got.Friends) != 2 {
+		t.Fatalf("embedded %d friends, want 2", len(got.Friends))
+	}
+	for i, want := range []struct {
+		id   string
+		age  int
+		deg  int
+		name string
+	}{{a, 31, 2, "a"}, {b, 42, 2, "b"}} {
+		friend := got.Friends[i]
+		if friend.ID != want.id || friend.Name != want.name || friend.Age != want.age || len(friend.Friends) != want.deg {
+			t.Errorf("friend %d = %+v, want %s (%s, %d) with %d friends", i, friend, want.id, want.name, want.age, want.deg)
+		}
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/404/full", ""), http.StatusNotFound)
+}
+
+func TestConcurrentIdenticalFriendshipsAddOneEdge(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 20)
+
+	const calls = 100
+	var wg sync.WaitGroup
+	created := make(chan bool, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			source, target := a, b
+			if i%2 == 1 {
+				source, target = b, a
+			}
+			rec := do(t, h, http.MethodPost, "/make_friends", `{"source_id":"`+source+`","target_id":"`+target+`"}`)
+			var got struct{ Created bool }
+			json.Unmarshal(rec.Body.Bytes(), &got)
+			created <- got.Created
+		}(i)
+	}
+	wg.Wait()
+	close(created)
+
+	n := 0
+	for c := range created {
+		if c {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d calls report creating the friendship, want 1", n)
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	if got := users[a].friendIDs(); !slices.Equal(got, []string{b}) {
+		t.Errorf("user %s friends = %v, want [%s]", a, got, b)
+	}
+	if got := users[b].friendIDs(); !slices.Equal(got, []string{a}) {
+		t.Errorf("user %s friends = %v, want [%s]", b, got, a)
+	}
+}
+
+func TestDecodeKeepsLargeNumbers(t *testing.T) {
+	const big = "9007199254740993" // 2^53 + 1, not representable as a float64
+
+	var v map[string]any
+	if err := decodeBody(strings.NewReader(`{"n":`+big+`}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	n, ok := v["n"].(json.Number)
+	if !ok || n.String() != big {
+		t.Errorf("decoded %#v, want json.Number %s", v["n"], big)
+	}
+
+	resetState(t)
+	h := newRouter()
+	rec := do(t, h, http.MethodPost, "/rpc", `{"jsonrpc":"2.0","id":`+big+`,"method":"listUsers"}`)
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), `"id":`+big) {
+		t.Errorf("JSON-RPC id not echoed exactly: %s", rec.Body)
+	}
+}
+
+func TestListUsersInRegistrationOrder(t *testing.T) {
+	resetState(t)
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	fake := useFakeClock(start)
+	h := newRouter()
+
+	for _, name := range []string{"c", "a", "b"} {
+		createUser(t, h, name, 20)
+		fake.Advance(time.Minute)
+	}
+	// Seeded users registered earlier than their IDs suggest, the case
+	// that matters once IDs are no longer sequential; 10 and 11 tie.
+	seedUsers(t, map[string]User{
+		"10": {Name: "early", CreatedAt: start.Add(-time.Hour)},
+		"11": {Name: "early too", CreatedAt: start.Add(-time.Hour)},
+		"9":  {Name: "middle", CreatedAt: start.Add(30 * time.Second)},
+	})
+
+	rec := do(t, h, http.MethodGet, "/users?order=registration", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got, want := responseIDs(t, rec), []string{"10", "11", "1", "9", "2", "3"}; !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/users?order=age", ""), http.StatusBadRequest)
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 20)
+	makeFriends(t, h, a, b)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, path := range []string{"/users", "/user/" + a, "/friends/" + a} {
+		get, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		getBody, _ := io.ReadAll(get.Body)
+		get.Body.Close()
+
+		head, err := http.Head(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headBody, _ := io.ReadAll(head.Body)
+		head.Body.Close()
+
+		if head.StatusCode != http.StatusOK || len(headBody) != 0 {
+			t.Errorf("HEAD %s: status %d with %d body bytes", path, head.StatusCode, len(headBody))
+		}
+		for _, name := range []string{"Content-Type", "Content-Length", "X-Total-Count"} {
+			if got, want := head.Header.Get(name), get.Header.Get(name); got != want {
+				t.Errorf("HEAD %s: %s = %q, GET has %q", path, name, got, want)
+			}
+		}
+		if want := strconv.Itoa(len(getBody)); head.Header.Get("Content-Length") != want {
+			t.Errorf("HEAD %s: Content-Length = %q, want %s", path, head.Header.Get("Content-Length"), want)
+		}
+	}
+}
+
+func TestRejectDuplicates(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		t.Run("reject="+strconv.FormatBool(reject), func(t *testing.T) {
+			resetState(t)
+			config.RejectDuplicates = reject
+			h := newRouter()
+
+			first := createUser(t, h, "Ann", 30)
+			createUser(t, h, "Ann", 31)
+			createUser(t, h, "Bob", 30)
+
+			want := http.StatusCreated
+			if reject {
+				want = http.StatusConflict
+			}
+			expectStatus(t, do(t, h, http.MethodPost, "/create", `{"name":"Ann","age":30}`), want)
+			expectStatus(t, do(t, h, http.MethodPost, "/create", `{"name":" Ann ","age":30}`), want)
+
+			// The index follows deletes, so the pair is free again.
+			expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":"`+first+`"}`), http.StatusNoContent)
+			createUser(t, h, "Ann", 30)
+		})
+	}
+}
+
+func TestFriendsTimeline(t *testing.T) {
+	resetState(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := useFakeClock(start)
+	h := newRouter()
+
+	a, b, d, e := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "d", 20), createUser(t, h, "e", 20)
+	c.Advance(time.Hour)
+	makeFriends(t, h, a, d)
+	c.Advance(time.Hour)
+	makeFriends(t, h, e, a)
+	c.Advance(time.Hour)
+	makeFriends(t, h, a, b)
+
+	rec := do(t, h, http.MethodGet, "/user/"+a+"/friends/timeline", "")
+	expectStatus(t, rec, http.StatusOK)
+	timeline := decodeResponse[[]friendSince](t, rec)
+	want := []friendSince{
+		{ID: b, Name: "b", Since: start.Add(3 * time.Hour)},
+		{ID: e, Name: "e", Since: start.Add(2 * time.Hour)},
+		{ID: d, Name: "d", Since: start.Add(time.Hour)},
+	}
+	if !slices.EqualFunc(timeline, want, func(x, y friendSince) bool {
+		return x.ID == y.ID && x.Name == y.Name && x.Since.Equal(y.Since)
+	}) {
+		t.Errorf("timeline = %+v, want %+v", timeline, want)
+	}
+
+	// Both ends of an edge share its timestamp.
+	timeline = decodeResponse[[]friendSince](t, do(t, h, http.MethodGet, "/user/"+e+"/friends/timeline", ""))
+	if len(timeline) != 1 || timeline[0].ID != a || !timeline[0].Since.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("timeline of %s = %+v", e, timeline)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/friends/timeline", ""), http.StatusNotFound)
+}
+
+func TestUsersSharingFriend(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	x, a, b, c := createUser(t, h, "x", 20), createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20)
+	makeFriends(t, h, c, x, a, x, b, c)
+
+	rec := do(t, h, http.MethodGet, "/users/sharing_friend/"+x, "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := responseIDs(t, rec); !slices.Equal(got, []string{a, c}) {
+		t.Errorf("users knowing %s = %v, want [%s %s]", x, got, a, c)
+	}
+	if got := responseIDs(t, do(t, h, http.MethodGet, "/users/sharing_friend/"+b, "")); !slices.Equal(got, []string{c}) {
+		t.Errorf("users knowing %s = %v, want [%s]", b, got, c)
+	}
+
+	createUser(t, h, "loner", 20)
+	if got := responseIDs(t, do(t, h, http.MethodGet, "/users/sharing_friend/5", "")); len(got) != 0 {
+		t.Errorf("users knowing a loner = %v", got)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/users/sharing_friend/404", ""), http.StatusNotFound)
+}
+
+func TestDeleteBatch(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b, c := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20)
+	makeFriends(t, h, a, b, b, c, a, c)
+
+	rec := do(t, h, http.MethodPost, "/users/delete_batch", `["`+a+`","99","`+b+`","`+a+`"]`)
+	expectStatus(t, rec, http.StatusOK)
+	type batchResult struct {
+		Deleted int            `json:"deleted"`
+		Results []deleteResult `json:"results"`
+	}
+	got := decodeResponse[batchResult](t, rec)
+	want := []deleteResult{{a, "deleted"}, {"99", "not_found"}, {b, "deleted"}, {a, "not_found"}}
+	if got.Deleted != 2 || !slices.Equal(got.Results, want) {
+		t.Errorf("got %+v, want 2 deleted and %+v", got, want)
+	}
+
+	user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+c, ""))
+	if len(user.Friends) != 0 {
+		t.Errorf("friends of %s = %v after its friends were deleted", c, user.Friends)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+a, ""), http.StatusNotFound)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/users/delete_batch", `{"ids":["1"]}`), http.StatusBadRequest)
+}
+
+func TestUpsertByExternalID(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	friend := createUser(t, h, "f", 20)
+
+	rec := do(t, h, http.MethodPut, "/users/by_external/crm-7", `{"name":"a","age":20,"friends":["`+friend+`"]}`)
+	expectStatus(t, rec, http.StatusCreated)
+	created := decodeResponse[userResponse](t, rec)
+	if created.ExternalID != "crm-7" || created.Name != "a" || !sameIDs(created.Friends, []string{friend}) {
+		t.Errorf("created = %+v", created)
+	}
+	if _, ok := friendWeights(t, h, friend)[created.ID]; !ok {
+		t.Errorf("%s does not list the new user %s as a friend", friend, created.ID)
+	}
+
+	rec = do(t, h, http.MethodPut, "/users/by_external/crm-7", `{"name":"b","age":21}`)
+	expectStatus(t, rec, http.StatusOK)
+	updated := decodeResponse[userResponse](t, rec)
+	if updated.ID != created.ID || updated.Name != "b" || updated.Age != 21 || !sameIDs(updated.Friends, []string{friend}) {
+		t.Errorf("updated = %+v, want %s renamed with its friends kept", updated, created.ID)
+	}
+
+	// Another external ID is another user.
+	rec = do(t, h, http.MethodPut, "/users/by_external/crm-8", `{"name":"b","age":21}`)
+	expectStatus(t, rec, http.StatusCreated)
+	if other := decodeResponse[userResponse](t, rec); other.ID == created.ID {
+		t.Errorf("crm-8 reused user %s", other.ID)
+	}
+
+	// The index follows deletes.
+	expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":"`+created.ID+`"}`), http.StatusNoContent)
+	expectStatus(t, do(t, h, http.MethodPut, "/users/by_external/crm-7", `{"name":"a","age":20}`), http.StatusCreated)
+}
+
+// friendWeights returns the weight of each of id's friends, as /friends
+// lists them.
+func friendWeights(t *testing.T, h http.Handler, id string) map[string]int {
+	t.Helper()
+	rec := do(t, h, http.MethodGet, "/friends/"+id, "")
+	expectStatus(t, rec, http.StatusOK)
+	weights := make(map[string]int)
+	for _, friend := range decodeResponse[[]friendResponse](t, rec) {
+		weights[friend.ID] = friend.Weight
+	}
+	return weights
+}
+
+func TestFriendshipWeight(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b, c := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20)
+	makeFriends(t, h, a, b, a, c)
+
+	if got := friendWeights(t, h, a); got[b] != 0 || got[c] != 0 {
+		t.Errorf("new friendships have weights %v, want 0", got)
+	}
+
+	rec := do(t, h, http.MethodPost, "/friends/"+b+"/"+a+"/weight", `{"weight":5}`)
+	expectStatus(t, rec, http.StatusOK)
+	if got := friendWeights(t, h, a); got[b] != 5 || got[c] != 0 {
+		t.Errorf("weights of %s = %v, want %s at 5", a, got, b)
+	}
+	if got := friendWeights(t, h, b); got[a] != 5 {
+		t.Errorf("weights of %s = %v, want %s at 5", b, got, a)
+	}
+
+	expectStatus(t, do(t, h, http.MethodPost, "/friends/"+a+"/"+b+"/weight", `{"weight":-1}`), http.StatusBadRequest)
+	expectStatus(t, do(t, h, http.MethodPost, "/friends/"+a+"/"+b+"/weight", `{}`), http.StatusBadRequest)
+	expectStatus(t, do(t, h, http.MethodPost, "/friends/"+b+"/"+c+"/weight", `{"weight":1}`), http.StatusConflict)
+	expectStatus(t, do(t, h, http.MethodPost, "/friends/"+a+"/99/weight", `{"weight":1}`), http.StatusNotFound)
+}
+
+func TestFriendsOfFriend(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	me, friend, fof, stranger := createUser(t, h, "me", 20), createUser(t, h, "friend", 20), createUser(t, h, "fof", 20), createUser(t, h, "stranger", 20)
+	makeFriends(t, h, me, friend, friend, fof, fof, stranger)
+
+	rec := do(t, h, http.MethodGet, "/user/"+me+"/friends/"+friend+"/friends", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := responseIDs(t, rec); !sameIDs(got, []string{me, fof}) {
+		t.Errorf("friends of %s = %v, want [%s %s]", friend, got, me, fof)
+	}
+
+	// fof is two hops away, so its friends stay hidden from me.
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+me+"/friends/"+fof+"/friends", ""), http.StatusForbidden)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+me+"/friends/"+me+"/friends", ""), http.StatusForbidden)
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/friends/"+friend+"/friends", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+me+"/friends/99/friends", ""), http.StatusNotFound)
+}
+
+func TestRecentUsers(t *testing.T) {
+	resetState(t)
+	c := useFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := newRouter()
+
+	a := createUser(t, h, "a", 20)
+	c.Advance(time.Hour)
+	b, d := createUser(t, h, "b", 20), createUser(t, h, "d", 20)
+
+	recent := func(query string) []string {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/users/recent"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		return responseIDs(t, rec)
+	}
+
+	// Nothing was modified yet, so creation time orders them; b and d tie.
+	if got := recent(""); !slices.Equal(got, []string{b, d, a}) {
+		t.Errorf("recent = %v, want [%s %s %s]", got, b, d, a)
+	}
+
+	c.Advance(time.Hour)
+	expectStatus(t, do(t, h, http.MethodPut, "/user_age/"+a, `{"new_age":21}`), http.StatusOK)
+	if got := recent(""); !slices.Equal(got, []string{a, b, d}) {
+		t.Errorf("recent = %v, want [%s %s %s]", got, a, b, d)
+	}
+	if got := recent("?limit=1&offset=1"); !slices.Equal(got, []string{b}) {
+		t.Errorf("second page = %v, want [%s]", got, b)
+	}
+}
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	resetState(t)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := useFakeClock(start)
+	h := newRouter()
+	id := createUser(t, h, "a", 20)
+	seen := start.Format(http.TimeFormat)
+
+	// Another client changes the user after this one read it.
+	c.Advance(time.Minute)
+	expectStatus(t, do(t, h, http.MethodPut, "/user_age/"+id, `{"new_age":21}`), http.StatusOK)
+
+	rec := do(t, h, http.MethodPut, "/user_age/"+id, `{"new_age":30}`, "If-Unmodified-Since", seen)
+	expectStatus(t, rec, http.StatusPreconditionFailed)
+	if got, want := rec.Header().Get("Last-Modified"), start.Add(time.Minute).Format(http.TimeFormat); got != want {
+		t.Errorf("Last-Modified = %q, want %q", got, want)
+	}
+	if age := userAge(t, h, id); age != 21 {
+		t.Errorf("stale update applied: age = %d", age)
+	}
+
+	// Sub-second precision in UpdatedAt does not fail a client that saw it.
+	c.Advance(500 * time.Millisecond)
+	expectStatus(t, do(t, h, http.MethodPut, "/user_age/"+id, `{"new_age":22}`), http.StatusOK)
+	fresh := start.Add(time.Minute).Format(http.TimeFormat)
+	expectStatus(t, do(t, h, http.MethodPut, "/user_age/"+id, `{"new_age":23}`, "If-Unmodified-Since", fresh), http.StatusOK)
+
+	expectStatus(t, do(t, h, http.MethodPut, "/user_age/"+id, `{"new_age":24}`, "If-Unmodified-Since", "yesterday"), http.StatusOK)
+}
+
+func TestUserIDsAreSorted(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	rec := do(t, h, http.MethodGet, "/users/ids", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+		t.Errorf("no users: body = %s, want []", got)
+	}
+
+	// Enough users that string order would put 10 before 2.
+	newGraph(t, h, 12)
+	expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":"5"}`), http.StatusNoContent)
+
+	got := decodeResponse[[]string](t, do(t, h, http.MethodGet, "/users/ids", ""))
+	want := []string{"1", "2", "3", "4", "6", "7", "8", "9", "10", "11", "12"}
+	if !slices.Equal(got, want) {
+		t.Errorf("ids = %v, want %v", got, want)
+	}
+	if got := decodeResponse[[]string](t, do(t, h, http.MethodGet, "/users/ids?limit=2&offset=8", "")); !slices.Equal(got, []string{"10", "11"}) {
+		t.Errorf("page = %v, want [10 11]", got)
+	}
+}
+
+func TestFriendIDsPagination(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	hub := createUser(t, h, "hub", 20)
+	want := []string{}
+	for i := 0; i < 25; i++ {
+		id := createUser(t, h, "f", 20)
+		makeFriends(t, h, id, hub)
+		want = append(want, id)
+	}
+	sortIDs(want)
+
+	type friendIDs struct {
+		IDs        []string `json:"ids"`
+		NextOffset *int     `json:"next_offset"`
+	}
+	got, pages := []string{}, 0
+	for offset := 0; ; {
+		pages++
+		rec := do(t, h, http.MethodGet, "/user/"+hub+"/friends/ids?limit=10&offset="+strconv.Itoa(offset), "")
+		expectStatus(t, rec, http.StatusOK)
+		if total := rec.Header().Get("X-Total-Count"); total != "25" {
+			t.Errorf("X-Total-Count = %q, want 25", total)
+		}
+		page := decodeResponse[friendIDs](t, rec)
+		got = append(got, page.IDs...)
+		if page.NextOffset == nil {
+			break
+		}
+		offset = *page.NextOffset
+	}
+	if pages != 3 || !slices.Equal(got, want) {
+		t.Errorf("%d pages of %v, want 3 pages of %v", pages, got, want)
+	}
+
+	for _, query := range []string{"limit=0", "offset=-1", "after=2"} {
+		expectStatus(t, do(t, h, http.MethodGet, "/user/"+hub+"/friends/ids?"+query, ""), http.StatusBadRequest)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/friends/ids", ""), http.StatusNotFound)
+}
+
+func TestListUsersFriendOf(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	x := createUser(t, h, "x", 50)
+	young, old, older := createUser(t, h, "young", 18), createUser(t, h, "old", 40), createUser(t, h, "older", 60)
+	stranger := createUser(t, h, "stranger", 40)
+	makeFriends(t, h, young, x, old, x, older, x, stranger, young)
+
+	list := func(query string) []string {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/users?order=registration&"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		return responseIDs(t, rec)
+	}
+
+	if got := list("friend_of=" + x); !slices.Equal(got, []string{young, old, older}) {
+		t.Errorf("friends of %s = %v", x, got)
+	}
+	if got := list("friend_of=" + x + "&min_age=30&max_age=50"); !slices.Equal(got, []string{old}) {
+		t.Errorf("friends of %s aged 30 to 50 = %v, want [%s]", x, got, old)
+	}
+	if got := list("friend_of=" + x + "&min_age=70"); len(got) != 0 {
+		t.Errorf("friends of %s over 70 = %v", x, got)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/users?friend_of=99", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodGet, "/users?friend_of=", ""), http.StatusBadRequest)
+}
+
+func TestUserChangesSince(t *testing.T) {
+	resetState(t)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeClock(start)
+	h := newRouter()
+
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 20)
+	fake.Advance(time.Minute)
+	expectStatus(t, do(t, h, http.MethodPut, "/user_age/"+a, `{"new_age":21}`), http.StatusOK)
+	fake.Advance(time.Minute)
+	c := createUser(t, h, "c", 20)
+	fake.Advance(time.Minute)
+	makeFriends(t, h, c, b)
+
+	changes := func(since time.Time) ([]string, string) {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/users/changes?since="+since.Format(time.RFC3339), "")
+		expectStatus(t, rec, http.StatusOK)
+		return responseIDs(t, rec), rec.Header().Get("X-Total-Count")
+	}
+
+	tests := []struct {
+		since time.Time
+		want  []string
+	}{
+		{start.Add(-time.Second), []string{a, b, c}},
+		{start, []string{a, b, c}},
+		{start.Add(time.Minute), []string{b, c}},
+		{start.Add(3 * time.Minute), []string{}},
+	}
+	for _, tt := range tests {
+		got, total := changes(tt.since)
+		if !slices.Equal(got, tt.want) || total != strconv.Itoa(len(tt.want)) {
+			t.Errorf("since %s: got %v (total %s), want %v", tt.since.Format(time.TimeOnly), got, total, tt.want)
+		}
+	}
+
+	rec := do(t, h, http.MethodGet, "/users/changes?since="+start.Format(time.RFC3339), "")
+	var updated []time.Time
+	for _, user := range decodeResponse[[]userResponse](t, rec) {
+		updated = append(updated, user.UpdatedAt)
+	}
+	if want := []time.Time{start.Add(time.Minute), start.Add(3 * time.Minute), start.Add(3 * time.Minute)}; !slices.EqualFunc(updated, want, time.Time.Equal) {
+		t.Errorf("updated_at = %v, want %v", updated, want)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/users/changes", ""), http.StatusBadRequest)
+	expectStatus(t, do(t, h, http.MethodGet, "/users/changes?since=yesterday", ""), http.StatusBadRequest)
+}
+
+func TestClearFriendsCleansBothSides(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b, c, d := createUser(t, h, "a", 20), createUser(t, h, "b", 20), createUser(t, h, "c", 20), createUser(t, h, "d", 20)
+	makeFriends(t, h, a, b, a, c, b, d)
+
+	type cleared struct {
+		UserID  string `json:"user_id"`
+		Removed int    `json:"removed"`
+	}
+	rec := do(t, h, http.MethodDelete, "/friends/"+a, "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[cleared](t, rec); got != (cleared{a, 2}) {
+		t.Errorf("response = %+v, want %s with 2 removed", got, a)
+	}
+
+	for id, want := range map[string][]string{a: nil, b: {d}, c: nil, d: {b}} {
+		var got []string
+		for friendID := range friendWeights(t, h, id) {
+			got = append(got, friendID)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("friends of %s = %v, want %v", id, got, want)
+		}
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+a, ""), http.StatusOK)
+
+	rec = do(t, h, http.MethodDelete, "/friends/"+a, "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[cleared](t, rec); got.Removed != 0 {
+		t.Errorf("second clear removed %d", got.Removed)
+	}
+	expectStatus(t, do(t, h, http.MethodDelete, "/friends/404", ""), http.StatusNotFound)
+}
+
+func TestMakeFriendsReportsCreated(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b := createUser(t, h, "Ann", 20), createUser(t, h, "Bob", 20)
+
+	type made struct {
+		Created bool   `json:"created"`
+		Message string `json:"message"`
+	}
+	tests := []struct {
+		source, target string
+		want           made
+	}{
+		{a, b, made{true, "Ann and Bob are now friends"}},
+		{a, b, made{false, "Ann and Bob are already friends"}},
+		{b, a, made{false, "Bob and Ann are already friends"}},
+	}
+	for i, tt := range tests {
+		body, _ := json.Marshal(friendshipRequest{SourceID: tt.source, TargetID: tt.target})
+		rec := do(t, h, http.MethodPost, "/make_friends", string(body))
+		expectStatus(t, rec, http.StatusOK)
+		if got := decodeResponse[made](t, rec); got != tt.want {
+			t.Errorf("call %d: %+v, want %+v", i+1, got, tt.want)
+		}
+	}
+
+	for id, want := range map[string]string{a: b, b: a} {
+		got := friendWeights(t, h, id)
+		if _, ok := got[want]; len(got) != 1 || !ok {
+			t.Errorf("friends of %s = %v, want only %s", id, got, want)
+		}
+	}
+}
+
+func TestUserAtIndex(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	for i := 1; i <= 12; i++ {
+		createUser(t, h, "u"+strconv.Itoa(i), 20)
+	}
+
+	at := func(index int) string {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/users/at/"+strconv.Itoa(index), "")
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[userResponse](t, rec).ID
+	}
+
+	// IDs sort numerically, so 10 comes after 9 rather than after 1.
+	for index, want := range map[int]string{0: "1", 1: "2", 8: "9", 9: "10", 11: "12"} {
+		if got := at(index); got != want {
+			t.Errorf("position %d = %s, want %s", index, got, want)
+		}
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/users/at/12", ""), http.StatusNotFound)
+
+	expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":"2"}`), http.StatusNoContent)
+	for index, want := range map[int]string{0: "1", 1: "3", 8: "10", 10: "12"} {
+		if got := at(index); got != want {
+			t.Errorf("after deleting 2: position %d = %s, want %s", index, got, want)
+		}
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/users/at/11", ""), http.StatusNotFound)
+
+	createUser(t, h, "u13", 20)
+	if got := at(11); got != "13" {
+		t.Errorf("after creating 13: position 11 = %s, want 13", got)
+	}
+
+	for _, index := range []string{"-1", "x"} {
+		expectStatus(t, do(t, h, http.MethodGet, "/users/at/"+index, ""), http.StatusBadRequest)
+	}
+}
+
+func TestEncodeFailureDropsStaleHeaders(t *testing.T) {
+	resetState(t)
+	config.CORSAllowedOrigins = []string{"*"}
+
+	for name, v := range map[string]any{"infinity": math.Inf(1), "channel": make(chan int)} {
+		t.Run(name, func(t *testing.T) {
+			h := cors(middleware.RequestID(exposeRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				setTotalCount(w, 3)
+				w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+				w.Header().Set("Content-Disposition", `attachment; filename="users.json"`)
+				writeJSON(w, r, http.StatusOK, map[string]any{"value": v})
+			}))))
+			captureLog(t)
+
+			rec := do(t, h, http.MethodGet, "/", "", "Origin", "https://app.example", "X-Request-Id", "req-1")
+			expectStatus(t, rec, http.StatusInternalServerError)
+			if got := decodeResponse[errorResponse](t, rec); got != (errorResponse{"Failed to build response", "req-1"}) {
+				t.Errorf("body = %+v", got)
+			}
+			for _, name := range []string{"X-Total-Count", "Last-Modified", "Content-Disposition"} {
+				if got := rec.Header().Get(name); got != "" {
+					t.Errorf("%s = %q survived the encode failure", name, got)
+				}
+			}
+			for name, want := range map[string]string{
+				"X-Request-Id":                "req-1",
+				"Access-Control-Allow-Origin": "*",
+				"Vary":                        "Origin",
+				"Content-Type":                "application/json",
+				"Content-Length":              strconv.Itoa(rec.Body.Len()),
+			} {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateWithFriends(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 20)
+
+	for body, want := range map[string]string{
+		`{"name":"c","age":20,"friends":["` + a + `","999","999"]}`: "Invalid friend IDs: 999",
+		`{"name":"c","age":20,"friends":["` + a + `","` + a + `"]}`: "Invalid friend IDs: " + a,
+		`{"name":"c","age":-1}`:  "Age must be between 0 and 150",
+		`{"name":"c","age":151}`: "Age must be between 0 and 150",
+	} {
+		rec := do(t, h, http.MethodPost, "/create", body)
+		expectStatus(t, rec, http.StatusBadRequest)
+		if got := decodeResponse[errorResponse](t, rec).Error; got != want {
+			t.Errorf("%s: error = %q, want %q", body, got, want)
+		}
+	}
+	if got := friendWeights(t, h, a); len(got) != 0 {
+		t.Errorf("rejected creations left %s with friends %v", a, got)
+	}
+
+	c := createUser(t, h, "c", 20)
+	rec := do(t, h, http.MethodPost, "/create", `{"name":"d","age":20,"friends":["`+a+`","`+b+`"]}`)
+	expectStatus(t, rec, http.StatusCreated)
+	d := strings.TrimPrefix(rec.Body.String(), "User ID: ")
+	for id, want := range map[string][]string{a: {d}, b: {d}, c: nil, d: {a, b}} {
+		var got []string
+		for friendID := range friendWeights(t, h, id) {
+			got = append(got, friendID)
+		}
+		if !sameIDs(got, want) {
+			t.Errorf("friends of %s = %v, want %v", id, got, want)
+		}
+	}
+	report := decodeResponse[integrityReport](t, do(t, h, http.MethodGet, "/admin/validate", "", admin...))
+	if !report.Valid {
+		t.Errorf("violations after create = %+v", report.Violations)
+	}
+
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/undo", "", admin...), http.StatusOK)
+	if got := friendWeights(t, h, a); len(got) != 0 {
+		t.Errorf("undoing the create left %s with friends %v", a, got)
+	}
+}
+
+func TestUserFriendsSkipMissingBeforePaging(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	seedUsers(t, map[string]User{
+		"1": {Name: "a", Friends: friendsOf("98", "2", "99", "3")},
+		"2": {Name: "b", Friends: friendsOf("1")},
+		"3": {Name: "c", Friends: friendsOf("1")},
+	})
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"2", "3"}},
+		{"limit=1", []string{"2"}},
+		{"limit=1&offset=1", []string{"3"}},
+		{"offset=2", []string{}},
+	} {
+		rec := do(t, h, http.MethodGet, "/friends/1?"+tt.query, "")
+		expectStatus(t, rec, http.StatusOK)
+		got := []string{}
+		for _, friend := range decodeResponse[[]friendResponse](t, rec) {
+			got = append(got, friend.ID)
+		}
+		if !slices.Equal(got, tt.want) || rec.Header().Get("X-Total-Count") != "2" {
+			t.Errorf("%q: friends %v, X-Total-Count %s; want %v of 2", tt.query, got, rec.Header().Get("X-Total-Count"), tt.want)
+		}
+	}
+}
+
+func TestMakeFriendsCompletesHalfEdges(t *testing.T) {
+	for _, existing := range []string{"source", "target"} {
+		t.Run(existing, func(t *testing.T) {
+			resetState(t)
+			admin := withAdmin(t)
+			h := newRouter()
+			// Only one side of the friendship between 1 and 2 is stored.
+			half := map[string]User{"1": {Name: "a"}, "2": {Name: "b"}}
+			if existing == "source" {
+				half["1"] = User{Name: "a", Friends: friendsOf("2")}
+			} else {
+				half["2"] = User{Name: "b", Friends: friendsOf("1")}
+			}
+			seedUsers(t, half)
+
+			rec := do(t, h, http.MethodPost, "/make_friends", `{"source_id":"1","target_id":"2"}`)
+			expectStatus(t, rec, http.StatusOK)
+			if got := decodeResponse[struct{ Created bool }](t, rec); !got.Created {
+				t.Errorf("completing a half-edge reported created = false")
+			}
+			for _, id := range []string{"1", "2"} {
+				if got := friendWeights(t, h, id); len(got) != 1 {
+					t.Errorf("friends of %s = %v, want one", id, got)
+				}
+			}
+
+			expectStatus(t, do(t, h, http.MethodPost, "/admin/undo", "", admin...), http.StatusOK)
+			for id, user := range half {
+				var want []string
+				if len(user.Friends) > 0 {
+					want = []string{user.Friends[0].ID}
+				}
+				var got []string
+				for friendID := range friendWeights(t, h, id) {
+					got = append(got, friendID)
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("after undo, friends of %s = %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+type requestKey struct {
+	route       string
+	statusClass string
+}
+
+// responseSizeBuckets are the upper bounds, in bytes, of the response size
+// histogram buckets.
+var responseSizeBuckets = []int{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20}
+
+// sizeHistogram counts responses per bucket of responseSizeBuckets, plus
+// the ones above the largest bound in the last slot.
+type sizeHistogram struct {
+	buckets []int64
+	count   int64
+	sum     int64
+}
+
+func (h *sizeHistogram) observe(size int) {
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(responseSizeBuckets)+1)
+	}
+	i := sort.SearchInts(responseSizeBuckets, size)
+	h.buckets[i]++
+	h.count++
+	h.sum += int64(size)
+}
+
+// Labels use the chi route template rather than the raw path so the number
+// of series stays bounded no matter which IDs clients request.
+var metrics = struct {
+	sync.Mutex
+	requests         map[requestKey]int64
+	validationErrors map[string]int64
+	responseSizes    map[string]*sizeHistogram
+	slowRequests     map[string]int64
+}{
+	requests:         make(map[requestKey]int64),
+	validationErrors: make(map[string]int64),
+	responseSizes:    make(map[string]*sizeHistogram),
+	slowRequests:     make(map[string]int64),
+}
+
+func routeLabel(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+	return "unmatched"
+}
+
+func statusClass(status int) string {
+	switch {
+	case status >= 500:
+		return "5xx"
+	case status >= 400:
+		return "4xx"
+	case status >= 300:
+		return "3xx"
+	default:
+		return "2xx"
+	}
+}
+
+func recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		route, size := routeLabel(r), ww.BytesWritten()
+		key := requestKey{route: route, statusClass: statusClass(status)}
+		metrics.Lock()
+		metrics.requests[key]++
+		h := metrics.responseSizes[route]
+		if h == nil {
+			h = &sizeHistogram{}
+			metrics.responseSizes[route] = h
+		}
+		h.observe(size)
+		metrics.Unlock()
+
+		if config.LargeResponseBytes > 0 && size > config.LargeResponseBytes {
+			log.Printf("warning: [%s] %s %s wrote a %d byte response, above large_response_bytes",
+				middleware.GetReqID(r.Context()), r.Method, r.URL.RequestURI(), size)
+		}
+	})
+}
+
+func countValidationError(r *http.Request) {
+	route := routeLabel(r)
+	metrics.Lock()
+	metrics.validationErrors[route]++
+	metrics.Unlock()
+}
+
+func countSlowRequest(route string) {
+	metrics.Lock()
+	metrics.slowRequests[route]++
+	metrics.Unlock()
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	keys := make([]requestKey, 0, len(metrics.requests))
+	for key := range metrics.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].statusClass < keys[j].statusClass
+	})
+
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "http_requests_total{route=%q,status_class=%q} %d\n", key.route, key.statusClass, metrics.requests[key])
+	}
+
+	routes := make([]string, 0, len(metrics.validationErrors))
+	for route := range metrics.validationErrors {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(w, "# TYPE http_validation_errors_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "http_validation_errors_total{route=%q} %d\n", route, metrics.validationErrors[route])
+	}
+
+	routes = make([]string, 0, len(metrics.slowRequests))
+	for route := range metrics.slowRequests {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(w, "# TYPE http_slow_requests_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "http_slow_requests_total{route=%q} %d\n", route, metrics.slowRequests[route])
+	}
+
+	routes = make([]string, 0, len(metrics.responseSizes))
+	for route := range metrics.responseSizes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(w, "# TYPE http_response_size_bytes histogram")
+	for _, route := range routes {
+		h := metrics.responseSizes[route]
+		var cumulative int64
+		for i, bound := range responseSizeBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "http_response_size_bytes_bucket{route=%q,le=\"%d\"} %d\n", route, bound, cumulative)
+		}
+		fmt.Fprintf(w, "http_response_size_bytes_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(w, "http_response_size_bytes_sum{route=%q} %d\n", route, h.sum)
+		fmt.Fprintf(w, "http_response_size_bytes_count{route=%q} %d\n", route, h.count)
+	}
+
+	if breaker, ok := userStore.(*storeBreaker); ok {
+		state, rejected := breaker.snapshot()
+		fmt.Fprintln(w, "# TYPE store_breaker_state gauge")
+		for s, name := range breakerStateNames {
+			value := 0
+			if breakerState(s) == state {
+				value = 1
+			}
+			fmt.Fprintf(w, "store_breaker_state{state=%q} %d\n", name, value)
+		}
+		fmt.Fprintln(w, "# TYPE store_breaker_rejected_total counter")
+		fmt.Fprintf(w, "store_breaker_rejected_total %d\n", rejected)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLargeResponseWarning(t *testing.T) {
+	resetState(t)
+	config.LargeResponseBytes = 500
+	h := newRouter()
+	for i := 0; i < 20; i++ {
+		createUser(t, h, "user", 30)
+	}
+	logs := captureLog(t)
+
+	responses := func() (count, sum int64) {
+		metrics.Lock()
+		defer metrics.Unlock()
+		if h := metrics.responseSizes["/users"]; h != nil {
+			return h.count, h.sum
+		}
+		return 0, 0
+	}
+	count, sum := responses()
+
+	rec := do(t, h, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusOK)
+	size := rec.Body.Len()
+	if size <= config.LargeResponseBytes {
+		t.Fatalf("listing is only %d bytes", size)
+	}
+	if out := logs.String(); !strings.Contains(out, "GET /users wrote a") || !strings.Contains(out, "above large_response_bytes") {
+		t.Errorf("no large response warning in log:\n%s", out)
+	}
+	if c, s := responses(); c != count+1 || s != sum+int64(size) {
+		t.Errorf("histogram count %d sum %d, want %d and %d", c, s, count+1, sum+int64(size))
+	}
+
+	logs.Reset()
+	expectStatus(t, do(t, h, http.MethodGet, "/users?limit=1", ""), http.StatusOK)
+	if out := logs.String(); strings.Contains(out, "large_response_bytes") {
+		t.Errorf("small response logged a warning:\n%s", out)
+	}
+
+	rec = do(t, h, http.MethodGet, "/metrics", "")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), `http_response_size_bytes_count{route="/users"}`) {
+		t.Errorf("/metrics has no response size histogram for /users:\n%s", rec.Body)
+	}
+}
+
+// metricValue reads the sample named series from h's /metrics output, 0 when
+// it has not been written yet.
+func metricValue(t *testing.T, h http.Handler, series string) int {
+	t.Helper()
+	rec := do(t, h, http.MethodGet, "/metrics", "")
+	expectStatus(t, rec, http.StatusOK)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+func TestMetricsLabelRequestsByRoute(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	// Counters are process-wide, so compare against the values before.
+	series := []string{
+		`http_requests_total{route="/user/{user_id}",status_class="4xx"}`,
+		`http_requests_total{route="/create",status_class="4xx"}`,
+		`http_validation_errors_total{route="/create"}`,
+	}
+	before := make([]int, len(series))
+	for i, s := range series {
+		before[i] = metricValue(t, h, s)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/404", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodPost, "/create", `{"name":"","age":20}`), http.StatusBadRequest)
+
+	for i, s := range series {
+		if got := metricValue(t, h, s); got != before[i]+1 {
+			t.Errorf("%s = %d, want %d", s, got, before[i]+1)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// inFlight counts requests currently being served.
+var inFlight atomic.Int64
+
+// exposeRequestID echoes the ID assigned by middleware.RequestID so clients
+// can quote it when reporting a failure.
+func exposeRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canonicalPath routes every request on its escaped path without a trailing
+// slash, so "/user/5/" is served as "/user/5" rather than redirected. chi
+// would otherwise route on the decoded path whenever the escaping is the
+// standard one: an ID containing "%2F" would split in two, a trailing
+// escaped slash would be stripped along with the real one, and pathParams
+// could not tell whether a value still needs decoding.
+func canonicalPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			path := r.URL.EscapedPath()
+			if len(path) > 1 {
+				path = strings.TrimSuffix(path, "/")
+			}
+			rctx.RoutePath = path
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		if contentType == "" && config.AllowMissingContentType {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			httpError(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitURILength rejects requests whose path plus query string is longer
+// than limit bytes with 414. A limit of zero or less disables the check.
+func limitURILength(limit int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.URL.RequestURI()) > limit {
+				httpError(w, r, http.StatusRequestURITooLong, "uri_too_long", limit)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maintenance is set while the service is read-only; see rejectWrites.
+var maintenance atomic.Bool
+
+// maintenanceRetryAfter is the Retry-After, in seconds, sent with writes
+// rejected during maintenance.
+const maintenanceRetryAfter = "60"
+
+// rejectWrites answers 503 to mutating requests while maintenance mode is on.
+// Admin routes stay writable so operators can restore state and turn the
+// mode off; /rpc is left to callRPC, since reads go through it too,
+// and /users/query only reads despite being a POST.
+func rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !maintenance.Load() || !mutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		if strings.HasPrefix(path, "/admin/") || path == "/rpc" || path == "/users/query" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+		httpError(w, r, http.StatusServiceUnavailable, "maintenance")
+	})
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// limitConcurrency caps the number of requests served at once. Requests that
+// arrive while every slot is taken get 503 instead of queueing. A limit of
+// zero or less disables the cap. The slots are shared by every handler the
+// middleware wraps, so a route group using it has one budget across its
+// routes.
+func limitConcurrency(limit int) func(http.Handler) http.Handler {
+	slots := make(chan struct{}, max(limit, 0))
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(w, r)
+			default:
+				w.Header().Set("Retry-After", "1")
+				httpError(w, r, http.StatusServiceUnavailable, "server_busy")
+			}
+		})
+	}
+}
+
+// cors answers browser preflights and marks responses readable by the
+// configured origins. Custom response headers are only visible to frontend
+// code when listed in Access-Control-Expose-Headers, hence
+// config.CORSExposedHeaders. With no allowed origins configured the
+// middleware does nothing.
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowAny := slices.Contains(config.CORSAllowedOrigins, "*")
+		if origin == "" || (!allowAny && !slices.Contains(config.CORSAllowedOrigins, origin)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if allowAny {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if len(config.CORSExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(config.CORSExposedHeaders, ", "))
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Pretty, X-Request-Id, X-Schema-Version, If-Unmodified-Since")
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// matchRoute returns the pattern of the route r will be routed to, or an
+// empty string when none matches.
+func matchRoute(routes chi.Routes, r *http.Request) string {
+	path := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+		path = rctx.RoutePath
+	}
+
+	for _, method := range []string{r.Method, http.MethodGet} {
+		rctx := chi.NewRouteContext()
+		if routes.Match(rctx, method, path) {
+			return rctx.RoutePattern()
+		}
+		// HEAD is served by GET routes, see middleware.GetHead.
+		if r.Method != http.MethodHead {
+			break
+		}
+	}
+	return ""
+}
+
+// routeTimeout returns the timeout configured for pattern, falling back to
+// config.RequestTimeout for unlisted routes.
+func routeTimeout(pattern string) time.Duration {
+	if d, ok := config.RouteTimeouts[pattern]; ok {
+		return time.Duration(d)
+	}
+	return time.Duration(config.RequestTimeout)
+}
+
+// limitDuration answers 503 for requests whose handler runs past the timeout
+// of their route. The route is looked up in routes before routing happens, so
+// the deadline covers the whole handler. A timeout of zero disables it for
+// that route; the handler's output is buffered otherwise, so streaming
+// routes need one.
+//
+// A handler that times out keeps running in the background, so it routes on
+// a routing context of its own: the router recycles the request's context as
+// soon as the 503 is sent, and the middleware above reads it for the route
+// label. Only a handler that finished hands its routing results back.
+func limitDuration(routes chi.Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pattern := matchRoute(routes, r)
+			timeout := routeTimeout(pattern)
+			outer := chi.RouteContext(r.Context())
+			if timeout <= 0 || outer == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			inner := chi.NewRouteContext()
+			inner.Routes, inner.RoutePath, inner.RouteMethod = outer.Routes, outer.RoutePath, outer.RouteMethod
+			done := make(chan struct{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(done)
+				next.ServeHTTP(w, r)
+			})
+
+			body, _ := json.Marshal(newErrorResponse(r, "request_timeout"))
+			ctx := context.WithValue(r.Context(), chi.RouteCtxKey, inner)
+			http.TimeoutHandler(handler, timeout, string(body)).ServeHTTP(jsonTimeout{w}, r.WithContext(ctx))
+
+			select {
+			case <-done:
+				outer.URLParams, outer.RoutePatterns = inner.URLParams, inner.RoutePatterns
+			default:
+				if pattern != "" {
+					outer.RoutePatterns = append(outer.RoutePatterns, pattern)
+				}
+			}
+		})
+	}
+}
+
+// jsonTimeout labels the 503 body http.TimeoutHandler writes on a timeout,
+// which carries no Content-Type of its own, as JSON. Every 503 the handlers
+// send is JSON too.
+type jsonTimeout struct {
+	http.ResponseWriter
+}
+
+func (w jsonTimeout) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// logSlowRequests logs a warning and counts the request in metrics when it
+// takes longer than the threshold of its route, config.SlowRequestThreshold
+// unless SlowRouteThresholds overrides it. A threshold of zero disables the
+// check for that route.
+func logSlowRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		elapsed := time.Since(start)
+
+		// The route is only known once the router has run.
+		route := routeLabel(r)
+		threshold := time.Duration(config.SlowRequestThreshold)
+		if d, ok := config.SlowRouteThresholds[route]; ok {
+			threshold = time.Duration(d)
+		}
+		if threshold <= 0 || elapsed <= threshold {
+			return
+		}
+
+		countSlowRequest(route)
+		log.Printf("warning: [%s] slow request %s %s took %s, above %s",
+			middleware.GetReqID(r.Context()), r.Method, route, elapsed.Round(time.Millisecond), threshold)
+	})
+}
+
+// redactedFields are JSON keys whose values body logging never prints.
+// redactedPattern finds them in bodies that do not parse, such as truncated
+// ones.
+var (
+	redactedFields  = map[string]bool{"email": true}
+	redactedPattern = regexp.MustCompile(`("email"\s*:\s*)"[^"]*"?`)
+)
+
+// redact replaces redactedFields values anywhere in a decoded JSON value.
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, inner := range v {
+			if redactedFields[key] {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = redact(inner)
+			}
+		}
+	case []any:
+		for i, inner := range v {
+			v[i] = redact(inner)
+		}
+	}
+	return v
+}
+
+// loggableBody renders body for the debug log with redactedFields masked and
+// the result cut to config.LogBodyLimit bytes. total is the size of the full
+// body, of which body may be only the start.
+func loggableBody(body []byte, total int) string {
+	var decoded any
+	redacted, err := []byte(nil), decodeBody(bytes.NewReader(body), &decoded)
+	if err == nil {
+		redacted, err = json.Marshal(redact(decoded))
+	}
+	if err == nil {
+		body = redacted
+	} else {
+		body = redactedPattern.ReplaceAll(body, []byte(`$1"[redacted]"`))
+	}
+	if len(body) > config.LogBodyLimit || total > len(body) {
+		return fmt.Sprintf("%s... (%d bytes)", body[:min(len(body), config.LogBodyLimit)], total)
+	}
+	return string(body)
+}
+
+// cappedBuffer keeps the first limit bytes written to it and discards the
+// rest while still reporting them as written.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+	total int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += len(p)
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// logBodies logs request and response bodies of mutating requests when
+// config.LogBodies is on. JSON request bodies are read in full and handed
+// to the handler again from memory; other bodies, such as uploads, stream
+// through unlogged. Values of redactedFields are masked, but a request body
+// cut short by LogBodyLimit is masked by pattern rather than parsed.
+func logBodies(next http.Handler) http.Handler {
+	if !config.LogBodies {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reqID := middleware.GetReqID(r.Context())
+
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" || mediaType == "" {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				httpError(w, r, http.StatusBadRequest, "invalid_body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			log.Printf("[%s] %s %s request: %s", reqID, r.Method, r.URL.Path, loggableBody(body, len(body)))
+		} else {
+			log.Printf("[%s] %s %s request: %s body not logged", reqID, r.Method, r.URL.Path, mediaType)
+		}
+
+		resp := &cappedBuffer{limit: config.LogBodyLimit}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(resp)
+		next.ServeHTTP(ww, r)
+
+		log.Printf("[%s] %s %s response %d: %s", reqID, r.Method, r.URL.Path, ww.Status(), loggableBody(resp.Bytes(), resp.total))
+	})
+}
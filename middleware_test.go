@@ -0,0 +1,308 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestCreateRequiresJSON(t *testing.T) {
+	const body = `{"name":"a","age":20}`
+
+	tests := []struct {
+		name         string
+		contentType  string
+		allowMissing bool
+		want         int
+	}{
+		{"json", "application/json", false, http.StatusCreated},
+		{"json with charset", "application/json; charset=utf-8", false, http.StatusCreated},
+		{"text", "text/plain", false, http.StatusUnsupportedMediaType},
+		{"malformed", "application/", false, http.StatusUnsupportedMediaType},
+		{"missing", "", false, http.StatusUnsupportedMediaType},
+		{"missing allowed", "", true, http.StatusCreated},
+		{"text with missing allowed", "text/plain", true, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState(t)
+			config.AllowMissingContentType = tt.allowMissing
+			rec := do(t, newRouter(), http.MethodPost, "/create", body, "Content-Type", tt.contentType)
+			expectStatus(t, rec, tt.want)
+		})
+	}
+}
+
+// blockingHandler holds every request until release is closed, signalling
+// on started as each one begins.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	resetState(t)
+
+	const limit = 2
+	started, release := make(chan struct{}), make(chan struct{})
+	h := limitConcurrency(limit)(blockingHandler(started, release))
+
+	var wg sync.WaitGroup
+	codes := make(chan int, limit)
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- do(t, h, http.MethodGet, "/users", "").Code
+		}()
+		<-started
+	}
+
+	rec := do(t, h, http.MethodGet, "/users", "")
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("503 without Retry-After")
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request within the limit got %d", code)
+		}
+	}
+
+	// The slots are free again.
+	go func() { <-started }()
+	expectStatus(t, do(t, h, http.MethodGet, "/users", ""), http.StatusOK)
+}
+
+func TestPerRouteTimeouts(t *testing.T) {
+	resetState(t)
+	config.RequestTimeout = duration(20 * time.Millisecond)
+	config.RouteTimeouts = map[string]duration{
+		"/slow/{id}": duration(time.Second),
+		"/stream":    0,
+	}
+
+	var routes []string
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			routes = append(routes, routeLabel(r))
+		})
+	})
+	r.Use(middleware.GetHead)
+	r.Use(limitDuration(r))
+	sleep := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(chi.URLParam(r, "id")))
+	}
+	r.Get("/fast/{id}", sleep)
+	r.Get("/slow/{id}", sleep)
+	r.Get("/stream", sleep)
+
+	rec := do(t, r, http.MethodGet, "/fast/1", "")
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("timeout Content-Type = %q, want application/json", ct)
+	}
+	if got := decodeResponse[errorResponse](t, rec).Error; got != "Request timed out" {
+		t.Errorf("timeout error = %q", got)
+	}
+
+	rec = do(t, r, http.MethodGet, "/slow/2", "")
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Body.String() != "2" {
+		t.Errorf("body = %q, want the URL parameter", rec.Body)
+	}
+	expectStatus(t, do(t, r, http.MethodGet, "/stream", ""), http.StatusOK)
+	expectStatus(t, do(t, r, http.MethodHead, "/fast/3", ""), http.StatusServiceUnavailable)
+
+	want := []string{"/fast/{id}", "/slow/{id}", "/stream", "/fast/{id}"}
+	if !slices.Equal(routes, want) {
+		t.Errorf("route labels = %v, want %v", routes, want)
+	}
+}
+
+func TestTrailingSlashIsIgnored(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	expectStatus(t, do(t, h, http.MethodPost, "/create/", `{"name":"a","age":20}`), http.StatusCreated)
+
+	for _, pair := range [][2]string{{"/user/1", "/user/1/"}, {"/users", "/users/"}, {"/friends/1", "/friends/1/"}} {
+		plain, slashed := do(t, h, http.MethodGet, pair[0], ""), do(t, h, http.MethodGet, pair[1], "")
+		expectStatus(t, slashed, http.StatusOK)
+		if plain.Body.String() != slashed.Body.String() {
+			t.Errorf("%s and %s differ: %s vs %s", pair[0], pair[1], plain.Body, slashed.Body)
+		}
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/", ""), http.StatusNotFound)
+}
+
+func TestTrailingEscapedSlashIsKept(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	const body = `{"name":"a","age":20}`
+
+	rec := do(t, h, http.MethodPut, "/users/by_external/a%2F/", body)
+	expectStatus(t, rec, http.StatusCreated)
+	if got := decodeResponse[userResponse](t, rec).ExternalID; got != "a/" {
+		t.Fatalf("external ID = %q, want a/", got)
+	}
+	expectStatus(t, do(t, h, http.MethodPut, "/users/by_external/a%2F", body), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodPut, "/users/by_external/a", body), http.StatusCreated)
+}
+
+func TestCORSExposesHeaders(t *testing.T) {
+	resetState(t)
+	config.CORSAllowedOrigins = []string{"https://app.example"}
+	config.CORSExposedHeaders = []string{"X-Total-Count", "X-Request-Id", "ETag"}
+	h := newRouter()
+	createUser(t, h, "a", 20)
+	const want = "X-Total-Count, X-Request-Id, ETag"
+
+	rec := do(t, h, http.MethodGet, "/users", "", "Origin", "https://app.example")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != want {
+		t.Errorf("Access-Control-Expose-Headers = %q, want %q", got, want)
+	}
+
+	rec = do(t, h, http.MethodOptions, "/users", "",
+		"Origin", "https://app.example", "Access-Control-Request-Method", "GET")
+	expectStatus(t, rec, http.StatusNoContent)
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != want {
+		t.Errorf("preflight Access-Control-Expose-Headers = %q, want %q", got, want)
+	}
+
+	rec = do(t, h, http.MethodGet, "/users", "", "Origin", "https://other.example")
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "" {
+		t.Errorf("disallowed origin gets Access-Control-Expose-Headers %q", got)
+	}
+}
+
+func TestLimitURILength(t *testing.T) {
+	resetState(t)
+	config.MaxURILength = 64
+	h := newRouter()
+	createUser(t, h, "a", 20)
+
+	expectStatus(t, do(t, h, http.MethodGet, "/users?limit=10", ""), http.StatusOK)
+
+	rec := do(t, h, http.MethodGet, "/users?ids="+strings.Repeat("1,", 40), "")
+	expectStatus(t, rec, http.StatusRequestURITooLong)
+	if !strings.Contains(rec.Body.String(), `"error"`) {
+		t.Errorf("414 body is not an error response: %s", rec.Body)
+	}
+
+	config.MaxURILength = 0
+	h = newRouter()
+	expectStatus(t, do(t, h, http.MethodGet, "/users?ids="+strings.Repeat("1,", 40), ""), http.StatusOK)
+}
+
+func TestLogBodiesKeepsRequestBody(t *testing.T) {
+	resetState(t)
+	config.LogBodies = true
+	logged := captureLog(t)
+	h := newRouter()
+
+	rec := do(t, h, http.MethodPost, "/create", `{"name":"Alice","age":30,"email":"alice@example.com"}`, schemaVersionHeader, "2")
+	expectStatus(t, rec, http.StatusCreated)
+	id := strings.TrimPrefix(rec.Body.String(), "User ID: ")
+
+	// The handler decoded the body the middleware had already read.
+	user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+id, ""))
+	if user.Name != "Alice" || user.Age != 30 || user.Email != "alice@example.com" {
+		t.Errorf("stored user = %+v", user)
+	}
+
+	out := logged.String()
+	if !strings.Contains(out, `"name":"Alice"`) || !strings.Contains(out, "User ID: "+id) {
+		t.Errorf("log lacks the request or response body:\n%s", out)
+	}
+	if strings.Contains(out, "alice@example.com") || !strings.Contains(out, "[redacted]") {
+		t.Errorf("email is not redacted:\n%s", out)
+	}
+	if strings.Contains(out, "GET") {
+		t.Errorf("read was logged:\n%s", out)
+	}
+}
+
+func TestLogBodiesTruncates(t *testing.T) {
+	resetState(t)
+	config.LogBodies = true
+	config.LogBodyLimit = 16
+	logged := captureLog(t)
+	h := newRouter()
+
+	body := `{"age":30,"email":"alice@example.com","name":"` + strings.Repeat("x", 100) + `"}`
+	expectStatus(t, do(t, h, http.MethodPost, "/create", body, schemaVersionHeader, "2"), http.StatusCreated)
+	if user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/1", "")); len(user.Name) != 100 {
+		t.Errorf("stored name has %d bytes, want 100", len(user.Name))
+	}
+
+	out := logged.String()
+	if strings.Contains(out, strings.Repeat("x", 17)) || !strings.Contains(out, "bytes)") {
+		t.Errorf("body is not truncated:\n%s", out)
+	}
+	if strings.Contains(out, "alice@") {
+		t.Errorf("email leaked through truncation:\n%s", out)
+	}
+}
+
+func TestLogSlowRequests(t *testing.T) {
+	resetState(t)
+	config.SlowRequestThreshold = duration(10 * time.Millisecond)
+	config.SlowRouteThresholds = map[string]duration{
+		"/lenient/{id}": duration(time.Second),
+		"/ignored":      0,
+	}
+	logs := captureLog(t)
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(logSlowRequests)
+	sleep := func(w http.ResponseWriter, r *http.Request) { time.Sleep(30 * time.Millisecond) }
+	r.Get("/slow/{id}", sleep)
+	r.Get("/lenient/{id}", sleep)
+	r.Get("/ignored", sleep)
+	r.Get("/fast", func(w http.ResponseWriter, r *http.Request) {})
+
+	slowCount := func(route string) int64 {
+		metrics.Lock()
+		defer metrics.Unlock()
+		return metrics.slowRequests[route]
+	}
+	before := map[string]int64{}
+	for _, route := range []string{"/slow/{id}", "/lenient/{id}", "/ignored", "/fast"} {
+		before[route] = slowCount(route)
+	}
+
+	for _, target := range []string{"/slow/1", "/lenient/1", "/ignored", "/fast"} {
+		expectStatus(t, do(t, r, http.MethodGet, target, "", "X-Request-Id", "req-"+strings.TrimPrefix(target, "/")), http.StatusOK)
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, "warning: [req-slow/1] slow request GET /slow/{id} took ") || !strings.Contains(out, "above 10ms") {
+		t.Errorf("no slow request warning for /slow/1:\n%s", out)
+	}
+	if n := strings.Count(out, "slow request"); n != 1 {
+		t.Errorf("%d slow request warnings, want 1:\n%s", n, out)
+	}
+	for route, want := range map[string]int64{"/slow/{id}": 1, "/lenient/{id}": 0, "/ignored": 0, "/fast": 0} {
+		if got := slowCount(route) - before[route]; got != want {
+			t.Errorf("%s counted %d slow requests, want %d", route, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// normalizeUsers strips self-friendships and repeated friend entries left by
+// older or hand-edited state, returning how many entries it dropped.
+func normalizeUsers(all map[string]User) int {
+	anomalies := 0
+	for id, user := range all {
+		seen := make(map[string]bool, len(user.Friends))
+		friends := make([]Friend, 0, len(user.Friends))
+		for _, friend := range user.Friends {
+			if friend.ID == id || seen[friend.ID] {
+				anomalies++
+				continue
+			}
+			seen[friend.ID] = true
+			friends = append(friends, friend)
+		}
+		user.Friends = friends
+		all[id] = user
+	}
+	return anomalies
+}
+
+// loadState reads a snapshot file written by /admin/snapshot and installs it
+// as the current state. A missing file is not an error.
+func loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("state file %s not found, starting empty", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	anomalies := normalizeUsers(s.Users)
+	if err := validateSnapshot(s); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	usersMutex.Lock()
+	replaceUsers(s.Users)
+	nextUserID = s.NextUserID
+	undoLog = nil
+	usersMutex.Unlock()
+
+	log.Printf("loaded %d users from %s, fixed %d friend list anomalies", len(s.Users), path, anomalies)
+	return nil
+}
+
+// saveState writes the current state to path in the format loadState reads.
+// The snapshot goes to a temporary file in the same directory first and is
+// renamed over path once synced, so a crash mid-write leaves the previous
+// snapshot intact.
+func saveState(path string) error {
+	usersMutex.RLock()
+	data, err := json.Marshal(snapshot{Users: users, NextUserID: nextUserID})
+	usersMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// snapshotPeriodically saves the state to path every interval until ctx is
+// cancelled. Failures are logged and retried at the next tick.
+func snapshotPeriodically(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveState(path); err != nil {
+				log.Printf("warning: snapshot to %s failed: %v", path, err)
+			}
+		}
+	}
+}
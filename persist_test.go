@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog collects everything logged until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestLoadStateNormalizesDirtyFile(t *testing.T) {
+	resetState(t)
+	logged := captureLog(t)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	dirty := `{"users":{
+		"1":{"name":"a","age":20,"friends":["1","2","2",{"id":"3","since":"2024-01-01T00:00:00Z"}]},
+		"2":{"name":"b","age":20,"friends":["1","2"]},
+		"3":{"name":"c","age":20,"friends":["1"]}
+	},"next_user_id":4}`
+	if err := os.WriteFile(path, []byte(dirty), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadState(path); err != nil {
+		t.Fatalf("loadState: %v", err)
+	}
+	if !strings.Contains(logged.String(), "fixed 3 friend list anomalies") {
+		t.Errorf("log does not report 3 anomalies: %s", logged)
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	if report := checkIntegrity(users); !report.Valid {
+		t.Errorf("loaded state still has violations: %+v", report.Violations)
+	}
+	if got := users["1"].friendIDs(); !sameIDs(got, []string{"2", "3"}) {
+		t.Errorf("user 1 friends = %v, want [2 3]", got)
+	}
+	if nextUserID != 4 {
+		t.Errorf("nextUserID = %d, want 4", nextUserID)
+	}
+}
+
+func TestLoadStateMissingFile(t *testing.T) {
+	resetState(t)
+	captureLog(t)
+	if err := loadState(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("loadState of a missing file = %v, want nil", err)
+	}
+}
+
+func TestSaveStateIsReloadable(t *testing.T) {
+	resetState(t)
+	captureLog(t)
+	h := newRouter()
+	a, b, c := createUser(t, h, "a", 20), createUser(t, h, "b", 30), createUser(t, h, "c", 40)
+	makeFriends(t, h, a, b, b, c)
+	expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":"`+c+`"}`), http.StatusNoContent)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte("previous"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveState(path); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want the snapshot alone", len(entries))
+	}
+
+	resetState(t)
+	if err := loadState(path); err != nil {
+		t.Fatal(err)
+	}
+	h = newRouter()
+	user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+b, ""))
+	if user.Name != "b" || user.Age != 30 || !slices.Equal(user.Friends, []string{a}) {
+		t.Errorf("reloaded user = %+v", user)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+c, ""), http.StatusNotFound)
+	if id := createUser(t, h, "d", 20); id != "4" {
+		t.Errorf("next user ID = %s, want 4", id)
+	}
+}
+
+func TestSnapshotPeriodically(t *testing.T) {
+	resetState(t)
+	captureLog(t)
+	createUser(t, newRouter(), "a", 20)
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		snapshotPeriodically(ctx, path, 10*time.Millisecond)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no snapshot written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-stopped
+
+	resetState(t)
+	if err := loadState(path); err != nil {
+		t.Fatal(err)
+	}
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	if len(users) != 1 || users["1"].Name != "a" {
+		t.Errorf("reloaded users = %+v", users)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// queryError is a rejected query string or request field, carried as a
+// catalog message so handlers can report it in the caller's locale.
+type queryError struct {
+	id   string
+	args []any
+}
+
+func (e *queryError) Error() string { return e.id }
+
+func invalidParam(name string) *queryError {
+	return &queryError{id: "invalid_param", args: []any{name}}
+}
+
+func writeQueryError(w http.ResponseWriter, r *http.Request, err *queryError) {
+	httpError(w, r, http.StatusBadRequest, err.id, err.args...)
+}
+
+// pathParams returns the named path parameters, URL-decoded. canonicalPath
+// has chi route on the escaped path, so each value is unescaped exactly
+// once here: "/user/%31" is user "1", "%2F" is a slash within the value and
+// "%2541" stays "%41". Empty values, bad escapes and control characters are
+// rejected.
+func pathParams(r *http.Request, names ...string) ([]string, *queryError) {
+	values := make([]string, len(names))
+	for i, name := range names {
+		v, err := url.PathUnescape(chi.URLParam(r, name))
+		if err != nil || v == "" || !utf8.ValidString(v) || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return nil, invalidParam(name)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func pathParam(r *http.Request, name string) (string, *queryError) {
+	values, err := pathParams(r, name)
+	if err != nil {
+		return "", err
+	}
+	return values[0], nil
+}
+
+func parseTimeParam(q url.Values, name string) (time.Time, *queryError) {
+	v := q.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, invalidParam(name)
+	}
+	return t, nil
+}
+
+// userFilter holds the list filters shared by the user listing endpoints.
+// Zero values mean the filter is not applied, except for the age bounds,
+// which default to the full valid range. All filters must match.
+type userFilter struct {
+	createdAfter  time.Time
+	createdBefore time.Time
+	minAge        int
+	maxAge        int
+	friendOf      string
+}
+
+func parseUserFilter(q url.Values) (userFilter, *queryError) {
+	var f userFilter
+	var err *queryError
+
+	if f.createdAfter, err = parseTimeParam(q, "created_after"); err != nil {
+		return f, err
+	}
+	if f.createdBefore, err = parseTimeParam(q, "created_before"); err != nil {
+		return f, err
+	}
+	if !f.createdAfter.IsZero() && !f.createdBefore.IsZero() && f.createdAfter.After(f.createdBefore) {
+		return f, &queryError{id: "invalid_time_range", args: []any{"created_after", "created_before"}}
+	}
+	if f.minAge, err = parseIntParam(q, "min_age", minAge, minAge); err != nil {
+		return f, err
+	}
+	if f.maxAge, err = parseIntParam(q, "max_age", maxAge, minAge); err != nil {
+		return f, err
+	}
+	if f.minAge > f.maxAge {
+		return f, &queryError{id: "invalid_range", args: []any{"min_age", "max_age"}}
+	}
+	if q.Has("friend_of") && q.Get("friend_of") == "" {
+		return f, invalidParam("friend_of")
+	}
+	f.friendOf = q.Get("friend_of")
+	return f, nil
+}
+
+func (f userFilter) match(user User) bool {
+	if !f.createdAfter.IsZero() && !user.CreatedAt.After(f.createdAfter) {
+		return false
+	}
+	if !f.createdBefore.IsZero() && !user.CreatedAt.Before(f.createdBefore) {
+		return false
+	}
+	if user.Age < f.minAge || user.Age > f.maxAge {
+		return false
+	}
+	if f.friendOf != "" && !user.hasFriend(f.friendOf) {
+		return false
+	}
+	return true
+}
+
+// parseIntParam reads an integer query parameter, returning def when it is
+// absent and an error when it is malformed or below min.
+func parseIntParam(q url.Values, name string, def, min int) (int, *queryError) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min {
+		return 0, invalidParam(name)
+	}
+	return n, nil
+}
+
+// parseFloatParam reads a number query parameter, returning def when it is
+// absent and an error when it is malformed or outside [min, max].
+func parseFloatParam(q url.Values, name string, def, min, max float64) (float64, *queryError) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(f >= min && f <= max) {
+		return 0, invalidParam(name)
+	}
+	return f, nil
+}
+
+func parseBoolParam(q url.Values, name string, def bool) (bool, *queryError) {
+	v := q.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, invalidParam(name)
+	}
+	return b, nil
+}
+
+// page is a validated limit/offset window. A missing limit falls back to
+// config.DefaultPageSize and a limit above config.MaxPageSize is clamped to
+// it rather than rejected, so clients asking for "everything" get the
+// largest allowed page and can follow X-Total-Count.
+//
+// after is an ID cursor: the page starts with the first ID sorted after it.
+// Only lists in ID order honour it (see afterCursor); it replaces offset, so
+// giving both is rejected.
+type page struct {
+	limit  int
+	offset int
+	after  string
+}
+
+// conflictingParams rejects a query that sets more than one of names, which
+// would otherwise make a handler silently prefer one of them.
+func conflictingParams(q url.Values, names ...string) *queryError {
+	var present []string
+	for _, name := range names {
+		if q.Has(name) {
+			present = append(present, name)
+		}
+	}
+	if len(present) > 1 {
+		return &queryError{id: "conflicting_params", args: []any{strings.Join(present, ", ")}}
+	}
+	return nil
+}
+
+func parsePage(q url.Values) (page, *queryError) {
+	if err := conflictingParams(q, "offset", "after"); err != nil {
+		return page{}, err
+	}
+	limit, err := parseIntParam(q, "limit", config.DefaultPageSize, 1)
+	if err != nil {
+		return page{}, err
+	}
+	offset, err := parseIntParam(q, "offset", 0, 0)
+	if err != nil {
+		return page{}, err
+	}
+	if q.Has("after") && q.Get("after") == "" {
+		return page{}, invalidParam("after")
+	}
+	return page{limit: min(limit, config.MaxPageSize), offset: offset, after: q.Get("after")}, nil
+}
+
+// afterCursor drops the IDs up to and including p.after from ids, which must
+// be sorted with sortIDs. The cursor need not exist any more.
+func afterCursor(ids []string, p page) []string {
+	if p.after == "" {
+		return ids
+	}
+	start := sort.Search(len(ids), func(i int) bool { return lessID(p.after, ids[i]) })
+	return ids[start:]
+}
+
+// paginate returns the window of items selected by p.
+func paginate[T any](items []T, p page) []T {
+	start := min(p.offset, len(items))
+	end := min(start+p.limit, len(items))
+	return items[start:end]
+}
+
+func setTotalCount(w http.ResponseWriter, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePageDefaultsAndClamping(t *testing.T) {
+	resetState(t)
+	config.DefaultPageSize = 2
+	config.MaxPageSize = 3
+
+	tests := []struct {
+		query string
+		want  page
+	}{
+		{"", page{limit: 2}},
+		{"limit=1", page{limit: 1}},
+		{"limit=3", page{limit: 3}},
+		{"limit=1000000", page{limit: 3}},
+		{"offset=4", page{limit: 2, offset: 4}},
+		{"after=7&limit=9", page{limit: 3, after: "7"}},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, qerr := parsePage(q)
+		if qerr != nil || got != tt.want {
+			t.Errorf("%q: got %+v, %v; want %+v", tt.query, got, qerr, tt.want)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=-1", "limit=x", "offset=-1", "after="} {
+		q, _ := url.ParseQuery(query)
+		if _, qerr := parsePage(q); qerr == nil {
+			t.Errorf("%q: accepted", query)
+		}
+	}
+}
+
+func TestListEndpointsSharePageSizes(t *testing.T) {
+	resetState(t)
+	config.DefaultPageSize = 2
+	config.MaxPageSize = 3
+	h := newRouter()
+	hub := createUser(t, h, "hub", 20)
+	for i := 0; i < 5; i++ {
+		makeFriends(t, h, hub, createUser(t, h, "u", 20))
+	}
+
+	for _, target := range []string{"/users/ids", "/friends/" + hub, "/followers/" + hub} {
+		if n := len(decodeResponse[[]any](t, do(t, h, http.MethodGet, target, ""))); n != 2 {
+			t.Errorf("%s: %d items by default, want 2", target, n)
+		}
+		rec := do(t, h, http.MethodGet, target+"?limit=500", "")
+		expectStatus(t, rec, http.StatusOK)
+		if n := len(decodeResponse[[]any](t, rec)); n != 3 {
+			t.Errorf("%s?limit=500: %d items, want the maximum of 3", target, n)
+		}
+		expectStatus(t, do(t, h, http.MethodGet, target+"?limit=0", ""), http.StatusBadRequest)
+	}
+}
+
+func TestConflictingParams(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 20)
+	makeFriends(t, h, a, b)
+
+	tests := []struct {
+		target, want string
+	}{
+		{"/users?offset=1&after=1", "offset, after"},
+		{"/users?order=registration&after=1", "order, after"},
+		{"/friends/" + a + "?offset=0&after=" + b, "offset, after"},
+		{"/followers/" + a + "?after=1&offset=1", "offset, after"},
+		{"/users/ids?offset=0&after=1", "offset, after"},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, tt.target, "")
+		expectStatus(t, rec, http.StatusBadRequest)
+		if !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: error does not list %q: %s", tt.target, tt.want, rec.Body)
+		}
+	}
+
+	for _, target := range []string{"/users?offset=1", "/users?after=1", "/users?order=registration&offset=1"} {
+		expectStatus(t, do(t, h, http.MethodGet, target, ""), http.StatusOK)
+	}
+}
+
+func TestPathParamsAreDecodedOnce(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	tests := []struct{ target, want string }{
+		{"/users/by_external/a%2541", "a%41"},
+		{"/users/by_external/a%2Fb", "a/b"},
+		{"/users/by_external/%E2%9C%93", "✓"},
+		{"/users/by_external/a%20b", "a b"},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodPut, tt.target, `{"name":"a","age":20}`)
+		expectStatus(t, rec, http.StatusCreated)
+		if got := decodeResponse[userResponse](t, rec).ExternalID; got != tt.want {
+			t.Errorf("%s: external_id = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/%31", ""), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/%2531", ""), http.StatusNotFound)
+
+	for _, target := range []string{"/user//friends/ids", "/relationship//1", "/user/%00", "/friends/a%0Ab"} {
+		rec := do(t, h, http.MethodGet, target, "")
+		expectStatus(t, rec, http.StatusBadRequest)
+		if !strings.Contains(rec.Body.String(), "parameter") {
+			t.Errorf("%s: body = %s", target, rec.Body)
+		}
+	}
+}
+
+func TestAfterCursorMixedIDs(t *testing.T) {
+	// Comparing "1a" as a string puts it after "10" but before "2", which
+	// sorts before "10" as a number; numeric IDs now come first.
+	ids := []string{"1a", "b", "10", "2", "9", "20"}
+	sortIDs(ids)
+	if want := []string{"2", "9", "10", "20", "1a", "b"}; !slices.Equal(ids, want) {
+		t.Fatalf("sorted %v, want %v", ids, want)
+	}
+
+	tests := []struct {
+		after string
+		want  []string
+	}{
+		{"9", []string{"10", "20", "1a", "b"}},
+		{"3", []string{"9", "10", "20", "1a", "b"}},
+		{"20", []string{"1a", "b"}},
+		{"1a", []string{"b"}},
+		{"1b", []string{"b"}},
+		{"b", []string{}},
+	}
+	for _, tt := range tests {
+		if got := afterCursor(ids, page{after: tt.after}); !slices.Equal(got, tt.want) {
+			t.Errorf("after=%s: got %v, want %v", tt.after, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+type ageSuggestion struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Age    int    `json:"age"`
+	AgeGap int    `json:"age_gap"`
+}
+
+// getAgeRecommendationsHandler suggests users who are not yet friends, not
+// blocked either way, and within window years of the user's age, closest
+// ages first, one page at a time.
+func getAgeRecommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	q := r.URL.Query()
+
+	window, qerr := parseIntParam(q, "window", 5, 0)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	suggestions := []ageSuggestion{}
+	for id, candidate := range users {
+		if id == userID || areFriends(userID, id) || blocks(userID, id) {
+			continue
+		}
+		gap := candidate.Age - user.Age
+		if gap < 0 {
+			gap = -gap
+		}
+		if gap <= window {
+			suggestions = append(suggestions, ageSuggestion{id, candidate.Name, candidate.Age, gap})
+		}
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].AgeGap != suggestions[j].AgeGap {
+			return suggestions[i].AgeGap < suggestions[j].AgeGap
+		}
+		return lessID(suggestions[i].ID, suggestions[j].ID)
+	})
+	setTotalCount(w, len(suggestions))
+
+	writeJSON(w, r, http.StatusOK, paginate(suggestions, pg))
+}
+
+// mutualCounts counts, for every user sharing at least one friend with
+// user, how many friends they share. The user and anyone on either side of
+// a block with them are left out, and so are their friends unless
+// withFriends is set. The caller must hold usersMutex.
+func mutualCounts(userID string, user User, withFriends bool) map[string]int {
+	mutual := make(map[string]int)
+	for _, friendID := range user.friendIDs() {
+		for _, candidate := range users[friendID].friendIDs() {
+			if candidate == userID || !withFriends && user.hasFriend(candidate) || blocks(userID, candidate) {
+				continue
+			}
+			if _, ok := users[candidate]; ok {
+				mutual[candidate]++
+			}
+		}
+	}
+	return mutual
+}
+
+type friendSuggestion struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Mutual int    `json:"mutual"`
+}
+
+// getRecommendationsHandler suggests friends of friends, most mutual friends
+// first. The user, their friends and anyone on either side of a block with
+// them are never suggested.
+func getRecommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	suggestions := friendSuggestions(userID, user, 1)
+	setTotalCount(w, len(suggestions))
+
+	writeJSON(w, r, http.StatusOK, paginate(suggestions, pg))
+}
+
+// friendSuggestions ranks the users sharing at least minMutual friends with
+// user, leaving out their friends, most mutual friends first and ties going
+// to the smaller ID. The caller must hold usersMutex.
+func friendSuggestions(userID string, user User, minMutual int) []friendSuggestion {
+	mutual := mutualCounts(userID, user, false)
+	suggestions := make([]friendSuggestion, 0, len(mutual))
+	for id, count := range mutual {
+		if count >= minMutual {
+			suggestions = append(suggestions, friendSuggestion{id, users[id].Name, count})
+		}
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Mutual != suggestions[j].Mutual {
+			return suggestions[i].Mutual > suggestions[j].Mutual
+		}
+		return lessID(suggestions[i].ID, suggestions[j].ID)
+	})
+	return suggestions
+}
+
+// getCandidatesHandler is getRecommendationsHandler with a floor on the
+// number of mutual friends, ?min_mutual (default 1).
+func getCandidatesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	q := r.URL.Query()
+	minMutual, qerr := parseIntParam(q, "min_mutual", 1, 1)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	pg, qerr := parsePage(q)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	candidates := friendSuggestions(userID, user, minMutual)
+	setTotalCount(w, len(candidates))
+
+	writeJSON(w, r, http.StatusOK, paginate(candidates, pg))
+}
+
+// getMostSimilarHandler returns the single user sharing the most friends
+// with the given one, ties going to the smaller ID. Friends are only
+// considered with ?include_friends=true. User is null when nobody shares a
+// friend with them.
+func getMostSimilarHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	includeFriends, qerr := parseBoolParam(r.URL.Query(), "include_friends", false)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	var best *friendSuggestion
+	for id, count := range mutualCounts(userID, user, includeFriends) {
+		if best == nil || count > best.Mutual || count == best.Mutual && lessID(id, best.ID) {
+			best = &friendSuggestion{id, users[id].Name, count}
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID string            `json:"user_id"`
+		User   *friendSuggestion `json:"user"`
+	}{userID, best})
+}
+
+// getRankedFriendsHandler lists the user's friends by how many friends each
+// shares with the user, most embedded first, ties going to the smaller ID.
+func getRankedFriendsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	mutual := mutualCounts(userID, user, true)
+	ranked := []friendSuggestion{}
+	for _, friendID := range user.friendIDs() {
+		if friend, ok := users[friendID]; ok {
+			ranked = append(ranked, friendSuggestion{friendID, friend.Name, mutual[friendID]})
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Mutual != ranked[j].Mutual {
+			return ranked[i].Mutual > ranked[j].Mutual
+		}
+		return lessID(ranked[i].ID, ranked[j].ID)
+	})
+	setTotalCount(w, len(ranked))
+
+	writeJSON(w, r, http.StatusOK, paginate(ranked, pg))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func ageSuggestionIDs(body []ageSuggestion) []string {
+	ids := []string{}
+	for _, s := range body {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func TestAgeRecommendations(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	me := createUser(t, h, "me", 30)
+	ages := map[string]int{}
+	for _, age := range []int{30, 33, 27, 35, 36, 20, 31} {
+		ages[createUser(t, h, "u", age)] = age
+	}
+	// User 2 (30) would be the best match but is already a friend.
+	makeFriends(t, h, me, "2")
+
+	rec := do(t, h, http.MethodGet, "/recommendations/"+me+"/by_age?window=5", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[[]ageSuggestion](t, rec)
+
+	// Gaps: 8 is 1, 3 and 4 are 3, 5 is 5; 6 and 7 are outside the window.
+	want := []string{"8", "3", "4", "5"}
+	if ids := ageSuggestionIDs(got); !slices.Equal(ids, want) {
+		t.Fatalf("suggestions = %v, want %v", ids, want)
+	}
+	for _, s := range got {
+		if gap := max(s.Age-30, 30-s.Age); s.AgeGap != gap || s.Age != ages[s.ID] {
+			t.Errorf("suggestion %+v has the wrong age or gap", s)
+		}
+	}
+
+	rec = do(t, h, http.MethodGet, "/recommendations/"+me+"/by_age?window=5&limit=2", "")
+	if ids := ageSuggestionIDs(decodeResponse[[]ageSuggestion](t, rec)); !slices.Equal(ids, want[:2]) {
+		t.Errorf("limited suggestions = %v, want %v", ids, want[:2])
+	}
+	if total := rec.Header().Get("X-Total-Count"); total != "4" {
+		t.Errorf("X-Total-Count = %q, want 4", total)
+	}
+}
+
+func TestAgeRecommendationsEmptyAndUnknown(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	me := createUser(t, h, "me", 30)
+	createUser(t, h, "far", 80)
+
+	rec := do(t, h, http.MethodGet, "/recommendations/"+me+"/by_age?window=5", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Body.String(); got != "[]\n" {
+		t.Errorf("body = %q, want an empty array", got)
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/recommendations/404/by_age", ""), http.StatusNotFound)
+	expectStatus(t, do(t, h, http.MethodGet, "/recommendations/"+me+"/by_age?window=-1", ""), http.StatusBadRequest)
+}
+
+func TestMostSimilar(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// 1's friends 2, 3 and 4 all know each other; 5 shares 2 and 3 with 1,
+	// and 6 only 4. 7 knows nobody.
+	newGraph(t, h, 7, "1", "2", "1", "3", "1", "4", "2", "3", "2", "4", "3", "4", "5", "2", "5", "3", "6", "4")
+
+	type similar struct {
+		UserID string            `json:"user_id"`
+		User   *friendSuggestion `json:"user"`
+	}
+	mostSimilar := func(query string) *friendSuggestion {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/user/"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[similar](t, rec).User
+	}
+
+	if got := mostSimilar("1/most_similar"); got == nil || got.ID != "5" || got.Mutual != 2 {
+		t.Errorf("most similar to 1 = %+v, want 5 with 2 mutual friends", got)
+	}
+	// Friends 2, 3 and 4 share as many as 5 does; the smallest ID wins.
+	if got := mostSimilar("1/most_similar?include_friends=true"); got == nil || got.ID != "2" || got.Mutual != 2 {
+		t.Errorf("most similar to 1 among everyone = %+v, want 2 with 2 mutual friends", got)
+	}
+	if got := mostSimilar("7/most_similar"); got != nil {
+		t.Errorf("most similar to a loner = %+v, want null", got)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/most_similar", ""), http.StatusNotFound)
+}
+
+func TestRankedFriends(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// Among 1's friends, 6 knows 3, 4 and 5; 4 and 5 know each other too.
+	newGraph(t, h, 7, "1", "2", "1", "3", "1", "4", "1", "5", "1", "6", "6", "3", "6", "4", "6", "5", "5", "4", "2", "7")
+
+	rec := do(t, h, http.MethodGet, "/user/1/friends/ranked", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[[]friendSuggestion](t, rec)
+	want := []friendSuggestion{{"6", "u6", 3}, {"4", "u4", 2}, {"5", "u5", 2}, {"3", "u3", 1}, {"2", "u2", 0}}
+	if !slices.Equal(got, want) {
+		t.Errorf("ranked = %+v, want %+v", got, want)
+	}
+
+	if got := decodeResponse[[]friendSuggestion](t, do(t, h, http.MethodGet, "/user/1/friends/ranked?limit=2&offset=1", "")); !slices.Equal(got, want[1:3]) {
+		t.Errorf("page = %+v, want %+v", got, want[1:3])
+	}
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/friends/ranked", ""), http.StatusNotFound)
+}
+
+func TestCandidates(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	// 1's friends are 2, 3 and 4. 5 knows all three, 6 and 7 two of them
+	// and 8 one; 9 knows all three too but 1 blocked them.
+	newGraph(t, h, 9,
+		"1", "2", "1", "3", "1", "4",
+		"5", "2", "5", "3", "5", "4",
+		"6", "2", "6", "3", "7", "3", "7", "4", "8", "2",
+		"9", "2", "9", "3", "9", "4")
+	expectStatus(t, do(t, h, http.MethodPost, "/user/1/block/9", ""), http.StatusNoContent)
+
+	candidates := func(query string) ([]friendSuggestion, string) {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/user/1/candidates?"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[[]friendSuggestion](t, rec), rec.Header().Get("X-Total-Count")
+	}
+
+	got, total := candidates("")
+	want := []friendSuggestion{{"5", "u5", 3}, {"6", "u6", 2}, {"7", "u7", 2}, {"8", "u8", 1}}
+	if !slices.Equal(got, want) || total != "4" {
+		t.Errorf("candidates = %v (total %s), want %v", got, total, want)
+	}
+
+	got, total = candidates("min_mutual=2&limit=2&offset=1")
+	if want := want[1:3]; !slices.Equal(got, want) || total != "3" {
+		t.Errorf("min_mutual=2 page = %v (total %s), want %v of 3", got, total, want)
+	}
+
+	got, total = candidates("min_mutual=4")
+	if len(got) != 0 || total != "0" {
+		t.Errorf("min_mutual=4 = %v (total %s), want none", got, total)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/1/candidates?min_mutual=0", ""), http.StatusBadRequest)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/404/candidates", ""), http.StatusNotFound)
+}
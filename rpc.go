@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// JSON-RPC 2.0 error codes. The -320xx range is reserved by the spec for
+// implementation errors; application errors use it for not found, conflict
+// and maintenance mode so clients can tell them from malformed calls.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcNotFound       = -32001
+	rpcConflict       = -32002
+	rpcUnavailable    = -32003
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Data carries the request ID, as error bodies elsewhere do.
+	Data any `json:"data,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func newRPCError(r *http.Request, code int, id string, args ...any) *rpcError {
+	return &rpcError{
+		Code:    code,
+		Message: msg(r, id, args...),
+		Data:    map[string]string{"request_id": middleware.GetReqID(r.Context())},
+	}
+}
+
+type rpcMethod func(r *http.Request, params json.RawMessage) (any, *rpcError)
+
+// rpcMethods maps JSON-RPC method names onto the same store helpers and
+// validation the REST handlers use, so both protocols behave alike.
+var rpcMethods = map[string]rpcMethod{
+	"createUser":  rpcCreateUser,
+	"getUser":     rpcGetUser,
+	"listUsers":   rpcListUsers,
+	"makeFriends": rpcMakeFriends,
+	"deleteUser":  rpcDeleteUser,
+	"getFriends":  rpcGetFriends,
+	"updateAge":   rpcUpdateAge,
+}
+
+// rpcWrites are the methods refused while maintenance mode is on.
+var rpcWrites = map[string]bool{
+	"createUser":  true,
+	"makeFriends": true,
+	"deleteUser":  true,
+	"updateAge":   true,
+}
+
+// rpcParams decodes params into v. Absent params decode as an empty object.
+func rpcParams(r *http.Request, params json.RawMessage, v any) *rpcError {
+	if len(params) == 0 {
+		params = []byte("{}")
+	}
+	if err := decodeBody(bytes.NewReader(params), v); err != nil {
+		return newRPCError(r, rpcInvalidParams, "invalid_body")
+	}
+	return nil
+}
+
+type rpcUserParams struct {
+	ID string `json:"id"`
+}
+
+type rpcPageParams struct {
+	ID     string `json:"id"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+// page mirrors parsePage: a missing limit means config.DefaultPageSize and
+// larger ones are clamped to config.MaxPageSize.
+func (p rpcPageParams) page(r *http.Request) (page, *rpcError) {
+	if p.Limit < 0 || p.Offset < 0 {
+		return page{}, newRPCError(r, rpcInvalidParams, "invalid_body")
+	}
+	limit := p.Limit
+	if limit == 0 {
+		limit = config.DefaultPageSize
+	}
+	return page{limit: min(limit, config.MaxPageSize), offset: p.Offset}, nil
+}
+
+func rpcCreateUser(r *http.Request, params json.RawMessage) (any, *rpcError) {
+	if len(params) == 0 {
+		params = []byte("{}")
+	}
+	request, qerr := decodeUserRequest(r.Header.Get(schemaVersionHeader), bytes.NewReader(params))
+	if qerr != nil {
+		return nil, newRPCError(r, rpcInvalidParams, qerr.id, qerr.args...)
+	}
+	newUser := request.toUser(clock().UTC())
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	userID, qerr := insertUser(newUser, request.Friends)
+	if qerr != nil {
+		code := rpcInvalidParams
+		if qerr.id == "duplicate_user" {
+			code = rpcConflict
+		}
+		return nil, newRPCError(r, code, qerr.id, qerr.args...)
+	}
+	return toUserResponse(userID, users[userID]), nil
+}
+
+func rpcGetUser(r *http.Request, params json.RawMessage) (any, *rpcError) {
+	var p rpcUserParams
+	if err := rpcParams(r, params, &p); err != nil {
+		return nil, err
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[p.ID]
+	if !exists {
+		return nil, newRPCError(r, rpcNotFound, "user_not_found")
+	}
+	return toUserResponse(p.ID, user), nil
+}
+
+func rpcListUsers(r *http.Request, params json.RawMessage) (any, *rpcError) {
+	var p rpcPageParams
+	if err := rpcParams(r, params, &p); err != nil {
+		return nil, err
+	}
+	pg, rerr := p.page(r)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	usersMutex.RLock()
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	usersMutex.RUnlock()
+	sortIDs(ids)
+
+	return struct {
+		Total int            `json:"total"`
+		Users []userResponse `json:"users"`
+	}{len(ids), lookupUsers(paginate(ids, pg))}, nil
+}
+
+func rpcMakeFriends(r *http.Request, params json.RawMessage) (any, *rpcError) {
+	var friendship friendshipRequest
+	if err := rpcParams(r, params, &friendship); err != nil {
+		return nil, err
+	}
+	if friendship.SourceID == friendship.TargetID {
+		return nil, newRPCError(r, rpcInvalidParams, "self_friendship")
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	_, _, created, errID := befriend(friendship.SourceID, friendship.TargetID)
+	switch errID {
+	case "":
+	case "blocked":
+		return nil, newRPCError(r, rpcConflict, errID)
+	default:
+		return nil, newRPCError(r, rpcNotFound, errID)
+	}
+	return struct {
+		friendshipRequest
+		Created bool `json:"created"`
+	}{friendship, created}, nil
+}
+
+// rpcDeleteUser is idempotent like DELETE /user; deleted tells whether the
+// user existed.
+func rpcDeleteUser(r *http.Request, params json.RawMessage) (any, *rpcError) {
+	var p rpcUserParams
+	if err := rpcParams(r, params, &p); err != nil {
+		return nil, err
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	return struct {
+		Deleted bool `json:"deleted"`
+	}{deleteUser(p.ID)}, nil
+}
+
+func rpcGetFriends(r *http.Request, params json.RawMessage) (any, *rpcError) {
+	var p rpcPageParams
+	if err := rpcParams(r, params, &p); err != nil {
+		return nil, err
+	}
+	pg, rerr := p.page(r)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	usersMutex.RLock()
+	user, exists := users[p.ID]
+	friendIDs := user.friendIDs()
+	usersMutex.RUnlock()
+
+	if !exists {
+		return nil, newRPCError(r, rpcNotFound, "user_not_found")
+	}
+	return struct {
+		Total   int            `json:"total"`
+		Friends []userResponse `json:"friends"`
+	}{len(friendIDs), lookupUsers(paginate(friendIDs, pg))}, nil
+}
+
+func rpcUpdateAge(r *http.Request, params json.RawMessage) (any, *rpcError) {
+	var p struct {
+		ID string `json:"id"`
+		updateAgeRequest
+	}
+	if err := rpcParams(r, params, &p); err != nil {
+		return nil, err
+	}
+	if id, args := p.validate(); id != "" {
+		return nil, newRPCError(r, rpcInvalidParams, id, args...)
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	user, ok := applyAgeUpdate(p.ID, p.updateAgeRequest)
+	if !ok {
+		return nil, newRPCError(r, rpcNotFound, "user_not_found")
+	}
+	return toUserResponse(p.ID, user), nil
+}
+
+// callRPC runs one call. Notifications, calls without an id, get no response
+// and callRPC returns nil for them.
+func callRPC(r *http.Request, raw json.RawMessage) *rpcResponse {
+	var call rpcRequest
+	if err := json.Unmarshal(raw, &call); err != nil || call.JSONRPC != "2.0" || call.Method == "" {
+		return &rpcResponse{JSONRPC: "2.0", Error: newRPCError(r, rpcInvalidRequest, "invalid_body"), ID: json.RawMessage("null")}
+	}
+
+	var result any
+	var rerr *rpcError
+	method, ok := rpcMethods[call.Method]
+	switch {
+	case !ok:
+		rerr = newRPCError(r, rpcMethodNotFound, "not_found")
+	case rpcWrites[call.Method] && maintenance.Load():
+		rerr = newRPCError(r, rpcUnavailable, "maintenance")
+	default:
+		result, rerr = method(r, call.Params)
+	}
+
+	if call.ID == nil {
+		return nil
+	}
+	if rerr != nil {
+		return &rpcResponse{JSONRPC: "2.0", Error: rerr, ID: call.ID}
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: result, ID: call.ID}
+}
+
+// rpcHandler serves JSON-RPC 2.0 over POST /rpc, single calls and batches
+// alike. Each call in a batch takes the store lock on its own, so a batch is
+// not atomic. Transport-level problems are reported as JSON-RPC errors with
+// status 200, as the spec expects; a request made only of notifications gets
+// 204.
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	body = bytes.TrimSpace(body)
+
+	if !json.Valid(body) {
+		writeJSON(w, r, http.StatusOK, rpcResponse{JSONRPC: "2.0", Error: newRPCError(r, rpcParseError, "invalid_body"), ID: json.RawMessage("null")})
+		return
+	}
+
+	if !bytes.HasPrefix(body, []byte("[")) {
+		if resp := callRPC(r, body); resp != nil {
+			writeJSON(w, r, http.StatusOK, resp)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch) == 0 {
+		writeJSON(w, r, http.StatusOK, rpcResponse{JSONRPC: "2.0", Error: newRPCError(r, rpcInvalidRequest, "invalid_body"), ID: json.RawMessage("null")})
+		return
+	}
+
+	responses := []*rpcResponse{}
+	for _, raw := range batch {
+		if resp := callRPC(r, raw); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, responses)
+}
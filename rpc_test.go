@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// rpcReply is an rpcResponse with the result left undecoded.
+type rpcReply struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func TestRPCSingleCall(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	rec := do(t, h, http.MethodPost, "/rpc", `{"jsonrpc":"2.0","method":"createUser","params":{"name":"a","age":20},"id":1}`)
+	expectStatus(t, rec, http.StatusOK)
+	reply := decodeResponse[rpcReply](t, rec)
+	if reply.JSONRPC != "2.0" || string(reply.ID) != "1" || reply.Error != nil {
+		t.Fatalf("reply = %+v", reply)
+	}
+	var user userResponse
+	if err := json.Unmarshal(reply.Result, &user); err != nil || user.ID != "1" || user.Name != "a" {
+		t.Errorf("result = %s, want user 1 named a", reply.Result)
+	}
+
+	// The REST API sees what RPC stored.
+	if got := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/1", "")); got.Name != "a" {
+		t.Errorf("user 1 = %+v", got)
+	}
+}
+
+func TestRPCBatch(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	createUser(t, h, "a", 20)
+	createUser(t, h, "b", 20)
+
+	rec := do(t, h, http.MethodPost, "/rpc", `[
+		{"jsonrpc":"2.0","method":"makeFriends","params":{"source_id":"1","target_id":"2"},"id":"f"},
+		{"jsonrpc":"2.0","method":"updateAge","params":{"id":"2","new_age":30}},
+		{"jsonrpc":"2.0","method":"getUser","params":{"id":"99"},"id":"g"},
+		{"jsonrpc":"2.0","method":"getFriends","params":{"id":"1"},"id":"l"}
+	]`)
+	expectStatus(t, rec, http.StatusOK)
+	replies := decodeResponse[[]rpcReply](t, rec)
+	if len(replies) != 3 {
+		t.Fatalf("replies = %+v, want one per call with an id", replies)
+	}
+	if string(replies[0].ID) != `"f"` || replies[0].Error != nil {
+		t.Errorf("makeFriends reply = %+v", replies[0])
+	}
+	if string(replies[1].ID) != `"g"` || replies[1].Error == nil || replies[1].Error.Code != rpcNotFound {
+		t.Errorf("getUser reply = %+v, want error %d", replies[1], rpcNotFound)
+	}
+	var friends struct {
+		Total   int
+		Friends []userResponse
+	}
+	if err := json.Unmarshal(replies[2].Result, &friends); err != nil || friends.Total != 1 || friends.Friends[0].ID != "2" {
+		t.Errorf("getFriends result = %s, want user 2", replies[2].Result)
+	}
+
+	// The notification ran although it got no reply.
+	if age := userAge(t, h, "2"); age != 30 {
+		t.Errorf("age of 2 = %d, want 30", age)
+	}
+
+	// A batch of notifications only has nothing to say.
+	expectStatus(t, do(t, h, http.MethodPost, "/rpc", `[{"jsonrpc":"2.0","method":"getUser","params":{"id":"1"}}]`), http.StatusNoContent)
+}
+
+func TestRPCErrors(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+
+	tests := []struct {
+		name, body string
+		code       int
+	}{
+		{"parse error", `{"jsonrpc":`, rpcParseError},
+		{"empty batch", `[]`, rpcInvalidRequest},
+		{"wrong version", `{"jsonrpc":"1.0","method":"getUser","id":1}`, rpcInvalidRequest},
+		{"unknown method", `{"jsonrpc":"2.0","method":"dropTables","id":1}`, rpcMethodNotFound},
+		{"bad params", `{"jsonrpc":"2.0","method":"createUser","params":{"name":"","age":20},"id":1}`, rpcInvalidParams},
+		{"self friendship", `{"jsonrpc":"2.0","method":"makeFriends","params":{"source_id":"1","target_id":"1"},"id":1}`, rpcInvalidParams},
+		{"missing user", `{"jsonrpc":"2.0","method":"getUser","params":{"id":"1"},"id":1}`, rpcNotFound},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodPost, "/rpc", tt.body)
+		expectStatus(t, rec, http.StatusOK)
+		reply := decodeResponse[rpcReply](t, rec)
+		if reply.Error == nil || reply.Error.Code != tt.code || reply.Error.Message == "" {
+			t.Errorf("%s: reply = %+v, want error %d", tt.name, reply, tt.code)
+		}
+		if reply.Result != nil {
+			t.Errorf("%s: error reply has a result: %s", tt.name, reply.Result)
+		}
+	}
+}
+
+func TestRPCCreateUserValidatesLikeREST(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	a := createUser(t, h, "a", 20)
+
+	call := func(params string) rpcReply {
+		t.Helper()
+		rec := do(t, h, http.MethodPost, "/rpc", `{"jsonrpc":"2.0","method":"createUser","params":`+params+`,"id":1}`)
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[rpcReply](t, rec)
+	}
+
+	for params, want := range map[string]string{
+		`{"name":"b","age":20,"friends":["777"]}`:                   "Invalid friend IDs: 777",
+		`{"name":"b","age":20,"friends":["` + a + `","` + a + `"]}`: "Invalid friend IDs: " + a,
+		`{"name":"b","age":200}`:                                    "Age must be between 0 and 150",
+	} {
+		reply := call(params)
+		if reply.Error == nil || reply.Error.Code != rpcInvalidParams || reply.Error.Message != want {
+			t.Errorf("%s: error = %+v, want %d %q", params, reply.Error, rpcInvalidParams, want)
+		}
+	}
+
+	reply := call(`{"name":"b","age":20,"friends":["` + a + `"]}`)
+	var user userResponse
+	if err := json.Unmarshal(reply.Result, &user); reply.Error != nil || err != nil || !sameIDs(user.Friends, []string{a}) {
+		t.Fatalf("reply = %+v, result %s", reply.Error, reply.Result)
+	}
+	if _, ok := friendWeights(t, h, a)[user.ID]; !ok {
+		t.Errorf("%s does not list %s created over RPC", a, user.ID)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Limits on the size of a /users/query query, so a single request cannot
+// make every user be matched against an arbitrarily large expression.
+const (
+	maxQueryDepth = 8
+	maxQueryNodes = 64
+)
+
+// userQuery is one node of a /users/query expression: either "and" or "or"
+// over nested nodes, or a single condition on a field. Supported fields and
+// operators:
+//
+//	id, email              eq, ne
+//	name                   eq, ne, contains, prefix (case-insensitive)
+//	age, friend_count      eq, ne, lt, lte, gt, gte
+//	friends                contains (the value is a user ID)
+//
+// Numeric fields take integer values, the others strings.
+type userQuery struct {
+	And   []userQuery `json:"and"`
+	Or    []userQuery `json:"or"`
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value any         `json:"value"`
+}
+
+type userPredicate func(id string, user User) bool
+
+var queryOps = map[string][]string{
+	"id":           {"eq", "ne"},
+	"email":        {"eq", "ne"},
+	"name":         {"eq", "ne", "contains", "prefix"},
+	"age":          {"eq", "ne", "lt", "lte", "gt", "gte"},
+	"friend_count": {"eq", "ne", "lt", "lte", "gt", "gte"},
+	"friends":      {"contains"},
+}
+
+// compile validates q and turns it into a predicate. nodes counts the nodes
+// compiled so far across the whole query.
+func (q userQuery) compile(depth int, nodes *int) (userPredicate, *queryError) {
+	*nodes++
+	if depth > maxQueryDepth || *nodes > maxQueryNodes {
+		return nil, &queryError{id: "query_too_large", args: []any{maxQueryDepth, maxQueryNodes}}
+	}
+
+	shapes := 0
+	for _, set := range []bool{q.And != nil, q.Or != nil, q.Field != ""} {
+		if set {
+			shapes++
+		}
+	}
+	if shapes != 1 {
+		return nil, &queryError{id: "query_shape"}
+	}
+
+	if q.And != nil || q.Or != nil {
+		children, all := q.And, true
+		if q.Or != nil {
+			children, all = q.Or, false
+		}
+		if len(children) == 0 {
+			return nil, &queryError{id: "query_shape"}
+		}
+		preds := make([]userPredicate, len(children))
+		for i, child := range children {
+			pred, err := child.compile(depth+1, nodes)
+			if err != nil {
+				return nil, err
+			}
+			preds[i] = pred
+		}
+		return func(id string, user User) bool {
+			for _, pred := range preds {
+				if pred(id, user) != all {
+					return !all
+				}
+			}
+			return all
+		}, nil
+	}
+	return q.condition()
+}
+
+func (q userQuery) condition() (userPredicate, *queryError) {
+	ops, ok := queryOps[q.Field]
+	if !ok {
+		return nil, &queryError{id: "query_field", args: []any{q.Field}}
+	}
+	if !slices.Contains(ops, q.Op) {
+		return nil, &queryError{id: "query_op", args: []any{q.Op, q.Field}}
+	}
+
+	switch q.Field {
+	case "age", "friend_count":
+		n, ok := q.Value.(json.Number)
+		if !ok {
+			return nil, invalidQueryValue(q.Field)
+		}
+		want, err := strconv.Atoi(n.String())
+		if err != nil {
+			return nil, invalidQueryValue(q.Field)
+		}
+		get := func(user User) int { return user.Age }
+		if q.Field == "friend_count" {
+			get = func(user User) int { return len(user.Friends) }
+		}
+		cmp := compareInts(q.Op)
+		return func(_ string, user User) bool { return cmp(get(user), want) }, nil
+	}
+
+	want, ok := q.Value.(string)
+	if !ok {
+		return nil, invalidQueryValue(q.Field)
+	}
+	switch q.Field {
+	case "id":
+		return func(id string, _ User) bool { return (id == want) == (q.Op == "eq") }, nil
+	case "email":
+		want = strings.ToLower(strings.TrimSpace(want))
+		return func(_ string, user User) bool { return (user.Email == want) == (q.Op == "eq") }, nil
+	case "friends":
+		return func(_ string, user User) bool { return user.hasFriend(want) }, nil
+	}
+
+	want = strings.ToLower(want)
+	return func(_ string, user User) bool {
+		name := strings.ToLower(user.Name)
+		switch q.Op {
+		case "eq":
+			return name == want
+		case "ne":
+			return name != want
+		case "contains":
+			return strings.Contains(name, want)
+		default:
+			return strings.HasPrefix(name, want)
+		}
+	}, nil
+}
+
+func invalidQueryValue(field string) *queryError {
+	return &queryError{id: "query_value", args: []any{field}}
+}
+
+func compareInts(op string) func(a, b int) bool {
+	switch op {
+	case "eq":
+		return func(a, b int) bool { return a == b }
+	case "ne":
+		return func(a, b int) bool { return a != b }
+	case "lt":
+		return func(a, b int) bool { return a < b }
+	case "lte":
+		return func(a, b int) bool { return a <= b }
+	case "gt":
+		return func(a, b int) bool { return a > b }
+	default:
+		return func(a, b int) bool { return a >= b }
+	}
+}
+
+// queryUsersHandler returns, a page at a time in ID order, the users
+// matching the userQuery in the body. It only reads, so it stays open in
+// maintenance mode.
+func queryUsersHandler(w http.ResponseWriter, r *http.Request) {
+	pg, qerr := parsePage(r.URL.Query())
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	var query userQuery
+	if err := decodeJSON(r, &query); err != nil {
+		httpError(w, r, http.StatusBadRequest, "invalid_body")
+		return
+	}
+	nodes := 0
+	match, qerr := query.compile(1, &nodes)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	ids := []string{}
+	for id, user := range users {
+		if match(id, user) {
+			ids = append(ids, id)
+		}
+	}
+	usersMutex.RUnlock()
+
+	sortIDs(ids)
+	setTotalCount(w, len(ids))
+
+	writeJSON(w, r, http.StatusOK, lookupUsers(paginate(afterCursor(ids, pg), pg)))
+}
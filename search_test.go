@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestQueryUsers(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	alice, alan := createUser(t, h, "Alice", 30), createUser(t, h, "Alan", 17)
+	bob, carol := createUser(t, h, "Bob", 40), createUser(t, h, "Carol", 25)
+	makeFriends(t, h, bob, alice, bob, carol)
+
+	tests := []struct {
+		name, body string
+		want       []string
+	}{
+		{"and", `{"and":[{"field":"age","op":"gte","value":18},{"field":"name","op":"contains","value":"al"}]}`,
+			[]string{alice}},
+		{"or", `{"or":[{"field":"age","op":"lt","value":18},{"field":"friend_count","op":"gte","value":2}]}`,
+			[]string{alan, bob}},
+		{"nested", `{"and":[{"field":"name","op":"ne","value":"bob"},{"or":[{"field":"friends","op":"contains","value":"` + bob + `"},{"field":"name","op":"prefix","value":"AL"}]}]}`,
+			[]string{alice, alan, carol}},
+		{"no match", `{"field":"id","op":"eq","value":"99"}`, []string{}},
+	}
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodPost, "/users/query", tt.body)
+		expectStatus(t, rec, http.StatusOK)
+		if got := responseIDs(t, rec); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	invalid := []struct{ body, want string }{
+		{`{"field":"height","op":"eq","value":1}`, `Unsupported query field "height"`},
+		{`{"field":"name","op":"gt","value":"a"}`, `Operator "gt" is not supported for field name`},
+		{`{"field":"age","op":"eq","value":"old"}`, "Invalid value for field age"},
+		{`{"field":"age","op":"eq","value":1.5}`, "Invalid value for field age"},
+		{`{"and":[]}`, "exactly one of"},
+		{`{"and":[{"field":"age","op":"eq","value":1}],"field":"name"}`, "exactly one of"},
+		{`{"or":[` + strings.Repeat(`{"field":"age","op":"eq","value":1},`, maxQueryNodes) + `{"field":"age","op":"eq","value":1}]}`, "levels deep"},
+		{`{"and":`, "Invalid"},
+	}
+	for _, tt := range invalid {
+		rec := do(t, h, http.MethodPost, "/users/query", tt.body)
+		expectStatus(t, rec, http.StatusBadRequest)
+		if got := decodeResponse[errorResponse](t, rec).Error; !strings.Contains(got, tt.want) {
+			t.Errorf("%s: error = %q, want it to mention %q", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tlsEnabled reports whether the API is served over HTTPS.
+func tlsEnabled() bool {
+	return config.TLSCertFile != ""
+}
+
+// newServer builds the HTTP server with the configured connection timeouts,
+// so a slow or idle client cannot hold a connection open indefinitely.
+func newServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(config.ReadTimeout),
+		WriteTimeout:      time.Duration(config.WriteTimeout),
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+	}
+	if tlsEnabled() {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return srv
+}
+
+// newRedirectServer builds the optional plaintext listener on
+// config.HTTPRedirectAddr, which sends every request to its HTTPS
+// equivalent.
+func newRedirectServer() *http.Server {
+	return &http.Server{
+		Addr:              config.HTTPRedirectAddr,
+		Handler:           http.HandlerFunc(redirectToHTTPS),
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout),
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+	}
+}
+
+// redirectToHTTPS answers 301 with the same host, path and query on the
+// HTTPS listener's port.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(config.Addr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// hsts tells browsers to use HTTPS only, for config.HSTSMaxAge, on responses
+// sent over TLS. It does nothing when max-age is zero.
+func hsts(next http.Handler) http.Handler {
+	maxAge := int64(time.Duration(config.HSTSMaxAge) / time.Second)
+	if maxAge <= 0 {
+		return next
+	}
+
+	value := "max-age=" + strconv.FormatInt(maxAge, 10) + "; includeSubDomains"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func listen(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
+
+// serve runs the servers until ctx is cancelled or one of them fails, then
+// drains in-flight requests for at most drainTimeout. Connections still busy
+// at the deadline are closed.
+func serve(ctx context.Context, drainTimeout time.Duration, servers ...*http.Server) error {
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			log.Printf("listening on %s", srv.Addr)
+			errCh <- listen(srv)
+		}(srv)
+	}
+
+	var failed error
+	select {
+	case failed = <-errCh:
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, draining %d in-flight requests", inFlight.Load())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	closeErrs := make(chan error, len(servers))
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.Printf("warning: drain timeout of %s reached with %d requests still in flight, forcing close",
+					drainTimeout, inFlight.Load())
+				closeErrs <- srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	close(closeErrs)
+
+	if failed != nil {
+		return failed
+	}
+	for err := range closeErrs {
+		if err != nil {
+			return err
+		}
+	}
+	for range servers {
+		if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	log.Print("server stopped")
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address with a port nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startSlowServer runs serve with a handler that holds each request until
+// release is closed, and waits until one request is in flight. It returns
+// that request's result and serve's.
+func startSlowServer(t *testing.T, ctx context.Context, drainTimeout time.Duration, release <-chan struct{}) (<-chan error, <-chan error) {
+	t.Helper()
+
+	started := make(chan struct{})
+	srv := &http.Server{
+		Addr:    freeAddr(t),
+		Handler: trackInFlight(blockingHandler(started, release)),
+	}
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, drainTimeout, srv) }()
+
+	requested := make(chan error, 1)
+	go func() {
+		for {
+			resp, err := http.Get("http://" + srv.Addr)
+			if err != nil {
+				// The listener may not be up yet.
+				if ctx.Err() == nil {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				requested <- err
+				return
+			}
+			resp.Body.Close()
+			requested <- nil
+			return
+		}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the handler")
+	}
+	if n := inFlight.Load(); n != 1 {
+		t.Errorf("in flight = %d, want 1", n)
+	}
+	return requested, served
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	resetState(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	requested, served := startSlowServer(t, ctx, 5*time.Second, release)
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-requested; err != nil {
+		t.Errorf("in-flight request failed during the drain: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve = %v, want nil", err)
+	}
+}
+
+func TestShutdownForcesCloseAfterDrainTimeout(t *testing.T) {
+	resetState(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer func() {
+		// Let the abandoned handler finish so later tests see no request
+		// in flight.
+		close(release)
+		for inFlight.Load() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	requested, served := startSlowServer(t, ctx, 50*time.Millisecond, release)
+
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the drain timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s with a 50ms drain timeout", elapsed)
+	}
+	if err := <-requested; err == nil {
+		t.Error("request held past the drain timeout completed, want its connection closed")
+	}
+}
+
+func TestNewServerSetsTimeouts(t *testing.T) {
+	resetState(t)
+
+	srv := newServer(http.NotFoundHandler())
+	// Each entry is the server's value and the documented default.
+	defaults := map[string][2]time.Duration{
+		"ReadHeaderTimeout": {srv.ReadHeaderTimeout, 5 * time.Second},
+		"ReadTimeout":       {srv.ReadTimeout, 30 * time.Second},
+		"WriteTimeout":      {srv.WriteTimeout, 60 * time.Second},
+		"IdleTimeout":       {srv.IdleTimeout, 120 * time.Second},
+	}
+	for name, d := range defaults {
+		if d[0] != d[1] {
+			t.Errorf("default %s = %v, want %v", name, d[0], d[1])
+		}
+	}
+
+	config.ReadHeaderTimeout = duration(time.Second)
+	config.ReadTimeout = duration(2 * time.Second)
+	config.WriteTimeout = duration(3 * time.Second)
+	config.IdleTimeout = duration(4 * time.Second)
+	srv = newServer(http.NotFoundHandler())
+	if srv.ReadHeaderTimeout != time.Second || srv.ReadTimeout != 2*time.Second ||
+		srv.WriteTimeout != 3*time.Second || srv.IdleTimeout != 4*time.Second {
+		t.Errorf("server timeouts = %v, %v, %v, %v; want 1s, 2s, 3s, 4s",
+			srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+	if srv.Addr != config.Addr || srv.Handler == nil {
+		t.Errorf("server = %+v", srv)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	resetState(t)
+
+	tests := []struct{ addr, target, want string }{
+		{":8443", "http://example.com:8080/user/1?pretty=true", "https://example.com:8443/user/1?pretty=true"},
+		{":443", "http://example.com/users?limit=2&offset=4", "https://example.com/users?limit=2&offset=4"},
+		{"127.0.0.1:9443", "http://example.com/a%2Fb", "https://example.com:9443/a%2Fb"},
+	}
+	for _, tt := range tests {
+		config.Addr = tt.addr
+		rec := do(t, newRedirectServer().Handler, http.MethodGet, tt.target, "")
+		expectStatus(t, rec, http.StatusMovedPermanently)
+		if got := rec.Header().Get("Location"); got != tt.want {
+			t.Errorf("%s on %s: Location = %q, want %q", tt.target, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestHSTSOnTLSResponses(t *testing.T) {
+	resetState(t)
+	config.HSTSMaxAge = duration(24 * time.Hour)
+	h := newRouter()
+
+	rec := do(t, h, http.MethodGet, "https://example.com/users/ids", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got, want := rec.Header().Get("Strict-Transport-Security"), "max-age=86400; includeSubDomains"; got != want {
+		t.Errorf("Strict-Transport-Security = %q, want %q", got, want)
+	}
+
+	rec = do(t, h, http.MethodGet, "http://example.com/users/ids", "")
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("plaintext response has Strict-Transport-Security %q", got)
+	}
+
+	config.HSTSMaxAge = 0
+	rec = do(t, newRouter(), http.MethodGet, "https://example.com/users/ids", "")
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("disabled HSTS sent %q", got)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// shutdownHook is work that must finish before the process exits, such as
+// writing the final snapshot.
+type shutdownHook struct {
+	name    string
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+var shutdownHooks []shutdownHook
+
+// onShutdown registers run to be called once the servers have drained.
+// Hooks run one at a time in registration order; each gets timeout, after
+// which it is abandoned and the next one starts.
+func onShutdown(name string, timeout time.Duration, run func(ctx context.Context) error) {
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, timeout, run})
+}
+
+// runShutdownHooks runs the registered hooks and logs how each one ended.
+func runShutdownHooks() {
+	for _, hook := range shutdownHooks {
+		ctx, cancel := context.WithTimeout(context.Background(), hook.timeout)
+		done := make(chan error, 1)
+		go func() { done <- hook.run(ctx) }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("warning: shutdown hook %s failed: %v", hook.name, err)
+			} else {
+				log.Printf("shutdown hook %s done", hook.name)
+			}
+		case <-ctx.Done():
+			log.Printf("warning: shutdown hook %s did not finish within %s", hook.name, hook.timeout)
+		}
+		cancel()
+	}
+}
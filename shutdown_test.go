@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownHooks(t *testing.T) {
+	saved := shutdownHooks
+	t.Cleanup(func() { shutdownHooks = saved })
+	shutdownHooks = nil
+	logs := captureLog(t)
+
+	var ran []string
+	onShutdown("flush", time.Second, func(ctx context.Context) error {
+		ran = append(ran, "flush")
+		return nil
+	})
+	onShutdown("broken", time.Second, func(ctx context.Context) error {
+		ran = append(ran, "broken")
+		return errors.New("disk full")
+	})
+	onShutdown("stuck", 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	onShutdown("last", time.Second, func(ctx context.Context) error {
+		ran = append(ran, "last")
+		return nil
+	})
+
+	runShutdownHooks()
+
+	if want := []string{"flush", "broken", "last"}; !slices.Equal(ran, want) {
+		t.Errorf("hooks ran %v, want %v", ran, want)
+	}
+	out := logs.String()
+	for _, want := range []string{
+		"shutdown hook flush done",
+		"shutdown hook broken failed: disk full",
+		"shutdown hook stuck did not finish within 10ms",
+		"shutdown hook last done",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type ageBucket struct {
+	From  int      `json:"from"`
+	To    int      `json:"to"`
+	Count int      `json:"count"`
+	Names []string `json:"names,omitempty"`
+}
+
+// ageHistogram groups users into buckets of size years, [0, size-1],
+// [size, 2*size-1] and so on, with [-size, -1] below them. Only non-empty buckets are returned, ordered
+// by age.
+func ageHistogram(members []User, size int, withNames bool) []ageBucket {
+	byStart := make(map[int]*ageBucket)
+	for _, user := range members {
+		// Round down, not toward zero, so -1 lands in [-size, -1].
+		start := user.Age / size * size
+		if user.Age < start {
+			start -= size
+		}
+		bucket, ok := byStart[start]
+		if !ok {
+			bucket = &ageBucket{From: start, To: start + size - 1}
+			byStart[start] = bucket
+		}
+		bucket.Count++
+		if withNames {
+			bucket.Names = append(bucket.Names, user.Name)
+		}
+	}
+
+	buckets := make([]ageBucket, 0, len(byStart))
+	for _, bucket := range byStart {
+		sort.Strings(bucket.Names)
+		buckets = append(buckets, *bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].From < buckets[j].From })
+	return buckets
+}
+
+func getFriendsByAgeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	q := r.URL.Query()
+
+	size, qerr := parseIntParam(q, "bucket", 10, 1)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	withNames, qerr := parseBoolParam(q, "names", false)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	friends := make([]User, 0, len(user.Friends))
+	for _, friendID := range user.friendIDs() {
+		if friend, ok := users[friendID]; ok {
+			friends = append(friends, friend)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID  string      `json:"user_id"`
+		Bucket  int         `json:"bucket"`
+		Buckets []ageBucket `json:"buckets"`
+	}{userID, size, ageHistogram(friends, size, withNames)})
+}
+
+// getUsersSampleHandler returns n users drawn without replacement, or every
+// user when n exceeds the population. The same seed over the same users
+// yields the same sample. Only the IDs are read under the lock; the chosen
+// users are then looked up in one batch.
+func getUsersSampleHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n, qerr := parseIntParam(q, "n", 10, 0)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+	seed, qerr := parseIntParam(q, "seed", int(time.Now().UnixNano()), math.MinInt)
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	usersMutex.RUnlock()
+
+	// Map order is random, so sort before shuffling to make seeds stable.
+	sortIDs(ids)
+	rng := rand.New(rand.NewSource(int64(seed)))
+	rng.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+	writeJSON(w, r, http.StatusOK, lookupUsers(ids[:min(n, len(ids))]))
+}
+
+// getClosestAgeFriendHandler returns the direct friend whose age is closest
+// to the user's, ties going to the smaller ID. Friend is null for users
+// without friends.
+func getClosestAgeFriendHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	var closest *ageSuggestion
+	for _, friendID := range user.friendIDs() {
+		friend, ok := users[friendID]
+		if !ok {
+			continue
+		}
+		gap := friend.Age - user.Age
+		if gap < 0 {
+			gap = -gap
+		}
+		if closest == nil || gap < closest.AgeGap || gap == closest.AgeGap && lessID(friendID, closest.ID) {
+			closest = &ageSuggestion{friendID, friend.Name, friend.Age, gap}
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID string         `json:"user_id"`
+		Friend *ageSuggestion `json:"friend"`
+	}{userID, closest})
+}
+
+type friendAge struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+// getFriendStatsHandler summarizes a user's friends for a profile page: how
+// many there are, their average age, the youngest and oldest (ties going to
+// the smaller ID) and how many friendships they have among themselves. The
+// age fields are null for users without friends.
+func getFriendStatsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, qerr := pathParam(r, "user_id")
+	if qerr != nil {
+		writeQueryError(w, r, qerr)
+		return
+	}
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	user, exists := users[userID]
+	if !exists {
+		httpError(w, r, http.StatusNotFound, "user_not_found")
+		return
+	}
+
+	friends := make(map[string]bool, len(user.Friends))
+	var youngest, oldest *friendAge
+	ageSum := 0
+	for _, friendID := range user.friendIDs() {
+		friend, ok := users[friendID]
+		if !ok || friendID == userID || friends[friendID] {
+			continue
+		}
+		friends[friendID] = true
+		ageSum += friend.Age
+
+		entry := &friendAge{friendID, friend.Name, friend.Age}
+		if youngest == nil || friend.Age < youngest.Age || friend.Age == youngest.Age && lessID(friendID, youngest.ID) {
+			youngest = entry
+		}
+		if oldest == nil || friend.Age > oldest.Age || friend.Age == oldest.Age && lessID(friendID, oldest.ID) {
+			oldest = entry
+		}
+	}
+
+	var averageAge *float64
+	if len(friends) > 0 {
+		avg := float64(ageSum) / float64(len(friends))
+		averageAge = &avg
+	}
+
+	writeJSON(w, r, http.StatusOK, struct {
+		UserID        string     `json:"user_id"`
+		FriendCount   int        `json:"friend_count"`
+		AverageAge    *float64   `json:"average_age"`
+		Youngest      *friendAge `json:"youngest"`
+		Oldest        *friendAge `json:"oldest"`
+		InternalEdges int        `json:"internal_edges"`
+	}{userID, len(friends), averageAge, youngest, oldest, len(inducedEdges(friends))})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSampleIsDeterministicForASeed(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	newGraph(t, h, 20)
+
+	sample := func(query string) []string {
+		t.Helper()
+		rec := do(t, h, http.MethodGet, "/users/sample?"+query, "")
+		expectStatus(t, rec, http.StatusOK)
+		return responseIDs(t, rec)
+	}
+
+	first := sample("n=5&seed=42")
+	if len(first) != 5 {
+		t.Fatalf("sample = %v, want 5 users", first)
+	}
+	if again := sample("n=5&seed=42"); !slices.Equal(again, first) {
+		t.Errorf("same seed gave %v, then %v", first, again)
+	}
+	seen := make(map[string]bool)
+	for _, id := range first {
+		if seen[id] {
+			t.Errorf("sample %v repeats %s", first, id)
+		}
+		seen[id] = true
+	}
+
+	everyone := sample("n=50&seed=1")
+	sortIDs(everyone)
+	want := make([]string, 20)
+	for i := range want {
+		want[i] = strconv.Itoa(i + 1)
+	}
+	if !slices.Equal(everyone, want) {
+		t.Errorf("oversized sample = %v, want all 20 users", everyone)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/users/sample?n=-1", ""), http.StatusBadRequest)
+}
+
+func TestClosestAgeFriend(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	me := createUser(t, h, "me", 30)
+	old, younger, older, young := createUser(t, h, "old", 60), createUser(t, h, "younger", 27), createUser(t, h, "older", 33), createUser(t, h, "young", 10)
+	makeFriends(t, h, me, old, me, older, me, younger, me, young)
+
+	type closest struct {
+		UserID string         `json:"user_id"`
+		Friend *ageSuggestion `json:"friend"`
+	}
+	rec := do(t, h, http.MethodGet, "/user/"+me+"/closest_age_friend", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[closest](t, rec)
+	// younger and older are both 3 years off; the smaller ID wins.
+	if got.Friend == nil || got.Friend.ID != younger || got.Friend.AgeGap != 3 {
+		t.Errorf("closest = %+v, want %s with a gap of 3", got.Friend, younger)
+	}
+
+	loner := createUser(t, h, "loner", 30)
+	rec = do(t, h, http.MethodGet, "/user/"+loner+"/closest_age_friend", "")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), `"friend":null`) {
+		t.Errorf("friendless user = %s, want a null friend", rec.Body)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/99/closest_age_friend", ""), http.StatusNotFound)
+}
+
+type friendStats struct {
+	FriendCount   int        `json:"friend_count"`
+	AverageAge    *float64   `json:"average_age"`
+	Youngest      *friendAge `json:"youngest"`
+	Oldest        *friendAge `json:"oldest"`
+	InternalEdges int        `json:"internal_edges"`
+}
+
+func TestFriendStats(t *testing.T) {
+	resetState(t)
+	h := newRouter()
+	me := createUser(t, h, "me", 30)
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 40)
+	c, d := createUser(t, h, "c", 20), createUser(t, h, "d", 40)
+	loner, stranger := createUser(t, h, "loner", 50), createUser(t, h, "stranger", 10)
+	// a-b and b-c are friends inside my neighborhood; c-stranger is outside it.
+	makeFriends(t, h, me, a, me, b, me, c, me, d, a, b, b, c, c, stranger)
+
+	rec := do(t, h, http.MethodGet, "/user/"+me+"/friend_stats", "")
+	expectStatus(t, rec, http.StatusOK)
+	got := decodeResponse[friendStats](t, rec)
+	if got.FriendCount != 4 || got.AverageAge == nil || *got.AverageAge != 30 || got.InternalEdges != 2 {
+		t.Errorf("stats = %+v", got)
+	}
+	if want := (friendAge{a, "a", 20}); got.Youngest == nil || *got.Youngest != want {
+		t.Errorf("youngest = %v, want %v", got.Youngest, want)
+	}
+	if want := (friendAge{b, "b", 40}); got.Oldest == nil || *got.Oldest != want {
+		t.Errorf("oldest = %v, want %v", got.Oldest, want)
+	}
+
+	rec = do(t, h, http.MethodGet, "/user/"+loner+"/friend_stats", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[friendStats](t, rec); got != (friendStats{}) {
+		t.Errorf("friendless stats = %+v, want zeros and nulls", got)
+	}
+
+	expectStatus(t, do(t, h, http.MethodGet, "/user/404/friend_stats", ""), http.StatusNotFound)
+
+	// A repeated entry counts once towards the average too.
+	resetState(t)
+	seedUsers(t, map[string]User{
+		"1": {Name: "me", Age: 30, Friends: friendsOf("2", "2", "2", "3", "99")},
+		"2": {Name: "a", Age: 10, Friends: friendsOf("1")},
+		"3": {Name: "b", Age: 50, Friends: friendsOf("1")},
+	})
+	rec = do(t, h, http.MethodGet, "/user/1/friend_stats", "")
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeResponse[friendStats](t, rec); got.FriendCount != 2 || got.AverageAge == nil || *got.AverageAge != 30 {
+		t.Errorf("stats with repeats = %+v, want 2 friends averaging 30", got)
+	}
+}
+
+func TestAgeHistogramBucketEdges(t *testing.T) {
+	tests := []struct {
+		age, size int
+		from, to  int
+	}{
+		{0, 10, 0, 9},
+		{9, 10, 0, 9},
+		{10, 10, 10, 19},
+		{-1, 10, -10, -1},
+		{-10, 10, -10, -1},
+		{-11, 10, -20, -11},
+		{7, 1, 7, 7},
+		{-7, 1, -7, -7},
+	}
+	for _, tt := range tests {
+		got := ageHistogram([]User{{Name: "a", Age: tt.age}}, tt.size, false)
+		if len(got) != 1 || got[0].From != tt.from || got[0].To != tt.to {
+			t.Errorf("age %d, size %d: buckets %+v, want [%d, %d]", tt.age, tt.size, got, tt.from, tt.to)
+		}
+	}
+}
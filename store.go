@@ -0,0 +1,84 @@
+package main
+
+// nameAgeKey identifies users by name and age. It is only an approximate
+// identity: two different people can share both.
+type nameAgeKey struct {
+	name string
+	age  int
+}
+
+// usersByNameAge counts users per name and age for the reject_duplicates
+// check. It is guarded by usersMutex and kept in sync by the helpers below,
+// which must be used for every write to users.
+var usersByNameAge = make(map[nameAgeKey]int)
+
+// usersByExternalID maps external IDs to user IDs for the upsert endpoint.
+// External IDs are unique; like usersByNameAge it is guarded by usersMutex.
+var usersByExternalID = make(map[string]string)
+
+func indexUser(id string, user User) {
+	usersByNameAge[nameAgeKey{user.Name, user.Age}]++
+	if user.ExternalID != "" {
+		usersByExternalID[user.ExternalID] = id
+	}
+}
+
+func unindexUser(id string, user User) {
+	key := nameAgeKey{user.Name, user.Age}
+	if usersByNameAge[key]--; usersByNameAge[key] <= 0 {
+		delete(usersByNameAge, key)
+	}
+	if usersByExternalID[user.ExternalID] == id {
+		delete(usersByExternalID, user.ExternalID)
+	}
+}
+
+// putUser stores user under id and stamps UpdatedAt; a new user's is its
+// CreatedAt. The caller must hold usersMutex for writing.
+func putUser(id string, user User) {
+	if old, ok := users[id]; ok {
+		unindexUser(id, old)
+		user.UpdatedAt = clock().UTC()
+	} else {
+		user.UpdatedAt = user.CreatedAt
+	}
+	users[id] = user
+	indexUser(id, user)
+}
+
+// dropUser removes the record stored under id without touching other users'
+// friend lists; see removeUser for that. The caller must hold usersMutex for
+// writing.
+func dropUser(id string) {
+	if old, ok := users[id]; ok {
+		unindexUser(id, old)
+		delete(users, id)
+	}
+}
+
+// replaceUsers swaps in a whole new user set and rebuilds the indexes.
+// The caller must hold usersMutex for writing.
+func replaceUsers(all map[string]User) {
+	users = all
+	usersByNameAge = make(map[nameAgeKey]int, len(all))
+	usersByExternalID = make(map[string]string)
+	for id, user := range all {
+		indexUser(id, user)
+	}
+}
+
+// lookupUsers fetches several users under a single read lock, in the order
+// given. IDs that no longer exist are skipped.
+func lookupUsers(ids []string) []userResponse {
+	found := make([]userResponse, 0, len(ids))
+
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	for _, id := range ids {
+		if user, ok := users[id]; ok {
+			found = append(found, toUserResponse(id, user))
+		}
+	}
+	return found
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// seedHighDegree stores a user "0" befriended with n others and returns the
+// friend IDs.
+func seedHighDegree(b *testing.B, n int) []string {
+	b.Helper()
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	replaceUsers(make(map[string]User))
+	hub := User{Name: "hub", Age: 30}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+		hub.Friends = append(hub.Friends, Friend{ID: ids[i]})
+		putUser(ids[i], User{Name: "friend", Age: 20, Friends: friendsOf("0")})
+	}
+	putUser("0", hub)
+	return ids
+}
+
+func BenchmarkLookupUsers(b *testing.B) {
+	ids := seedHighDegree(b, 5000)
+	b.ResetTimer()
+	for range b.N {
+		lookupUsers(ids)
+	}
+}
+
+// BenchmarkGetUserFriends reads one page of a high-degree user's friends,
+// which only hydrates the friends on that page.
+func BenchmarkGetUserFriends(b *testing.B) {
+	seedHighDegree(b, 5000)
+	config = defaultConfig()
+	h := newRouter()
+	req := httptest.NewRequest(http.MethodGet, "/friends/0", nil)
+
+	b.ResetTimer()
+	for range b.N {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+		}
+	}
+}
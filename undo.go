@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// maxUndoLog bounds how many operations can be undone.
+const maxUndoLog = 100
+
+// operation is a reversible mutation. The undo func runs with usersMutex held
+// for writing and must tolerate state that changed through non-reversible
+// operations since it was recorded.
+//
+// Reversible: create, make_friends, delete (the user is recreated under the
+// same ID with its edges to friends that still exist), delete_batch,
+// update_age and update_ages.
+// Anything not listed is not recorded; /admin/restore clears the log.
+type operation struct {
+	name string
+	undo func()
+}
+
+// undoLog is guarded by usersMutex.
+var undoLog []operation
+
+func recordUndo(name string, undo func()) {
+	undoLog = append(undoLog, operation{name: name, undo: undo})
+	if len(undoLog) > maxUndoLog {
+		undoLog = undoLog[len(undoLog)-maxUndoLog:]
+	}
+}
+
+// reinsertUser puts a deleted user back under its old ID, keeping only the
+// friendships whose other side still exists. The caller must hold usersMutex
+// for writing.
+func reinsertUser(userID string, user User) {
+	if _, taken := users[userID]; taken {
+		return
+	}
+
+	friends := []Friend{}
+	for _, link := range user.Friends {
+		friend, ok := users[link.ID]
+		if !ok {
+			continue
+		}
+		friend.Friends = append(friend.Friends, Friend{ID: userID, Since: link.Since, Weight: link.Weight})
+		putUser(link.ID, friend)
+		friends = append(friends, link)
+	}
+	user.Friends = friends
+	putUser(userID, user)
+}
+
+func undoHandler(w http.ResponseWriter, r *http.Request) {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	if len(undoLog) == 0 {
+		httpError(w, r, http.StatusConflict, "nothing_to_undo")
+		return
+	}
+
+	last := undoLog[len(undoLog)-1]
+	undoLog = undoLog[:len(undoLog)-1]
+	last.undo()
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, msg(r, "undone", last.name))
+}
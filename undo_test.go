@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUndoDelete(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+
+	a, b, c := createUser(t, h, "a", 20), createUser(t, h, "b", 30), createUser(t, h, "c", 40)
+	makeFriends(t, h, a, b, a, c)
+	expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":"`+a+`"}`), http.StatusNoContent)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/undo", "", admin...), http.StatusOK)
+
+	rec := do(t, h, http.MethodGet, "/user/"+a, "")
+	expectStatus(t, rec, http.StatusOK)
+	restored := decodeResponse[userResponse](t, rec)
+	if restored.Name != "a" || restored.Age != 20 || len(restored.Friends) != 2 {
+		t.Errorf("restored user = %+v, want a, 20, two friends", restored)
+	}
+	for _, id := range []string{b, c} {
+		friend := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+id, ""))
+		if len(friend.Friends) != 1 || friend.Friends[0] != a {
+			t.Errorf("user %s friends = %v, want [%s]", id, friend.Friends, a)
+		}
+	}
+}
+
+func TestUndoMakeFriends(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 30)
+	makeFriends(t, h, a, b)
+	// A repeat changes nothing, so it must not add a second undo entry.
+	makeFriends(t, h, b, a)
+
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/undo", "", admin...), http.StatusOK)
+
+	for _, id := range []string{a, b} {
+		user := decodeResponse[userResponse](t, do(t, h, http.MethodGet, "/user/"+id, ""))
+		if len(user.Friends) != 0 {
+			t.Errorf("user %s friends = %v, want none", id, user.Friends)
+		}
+	}
+	// Next in the log is b's creation.
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/undo", "", admin...), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodGet, "/user/"+b, ""), http.StatusNotFound)
+}
+
+func TestUndoEmptyLog(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	expectStatus(t, do(t, newRouter(), http.MethodPost, "/admin/undo", "", admin...), http.StatusConflict)
+}
+
+func TestUndoDeleteKeepsWeights(t *testing.T) {
+	resetState(t)
+	admin := withAdmin(t)
+	h := newRouter()
+
+	a, b := createUser(t, h, "a", 20), createUser(t, h, "b", 30)
+	makeFriends(t, h, a, b)
+	expectStatus(t, do(t, h, http.MethodPost, "/friends/"+a+"/"+b+"/weight", `{"weight":7}`), http.StatusOK)
+	expectStatus(t, do(t, h, http.MethodDelete, "/user", `{"target_id":"`+a+`"}`), http.StatusNoContent)
+	expectStatus(t, do(t, h, http.MethodPost, "/admin/undo", "", admin...), http.StatusOK)
+
+	if got := friendWeights(t, h, a); got[b] != 7 {
+		t.Errorf("weights of %s = %v, want %s at 7", a, got, b)
+	}
+	if got := friendWeights(t, h, b); got[a] != 7 {
+		t.Errorf("weights of %s = %v, want %s at 7", b, got, a)
+	}
+}